@@ -3,6 +3,7 @@ package drovedns
 import (
 	"fmt"
 	"sync"
+	"time"
 )
 
 // Host struct
@@ -37,8 +38,17 @@ type DroveAppsResponse struct {
 	Status  string     `json:"status"`
 	Apps    []DroveApp `json:"data"`
 	Message string     `json:"message"`
+	// byVhost is the index of Apps built by decodeStream
+	byVhost map[string]DroveApp
 }
 
+// apiResponse is implemented by drove api envelopes carrying a status field
+type apiResponse interface {
+	apiStatus() (string, string)
+}
+
+func (r *DroveAppsResponse) apiStatus() (string, string) { return r.Status, r.Message }
+
 type DroveApp struct {
 	ID    string             `json:"appId"`
 	Vhost string             `json:"vhost"`
@@ -57,52 +67,334 @@ type DroveEventsApiResponse struct {
 	Message      string            `json:"message"`
 }
 
+// DroveEvent is a single cluster event as delivered by the event stream.
+type DroveEvent struct {
+	Type     string                 `json:"type"`
+	ID       string                 `json:"id"`
+	Time     int64                  `json:"time"`
+	Metadata map[string]interface{} `json:"metadata"`
+}
+
+type DroveEventList struct {
+	Events       []*DroveEvent `json:"events"`
+	LastSyncTime int64         `json:"lastSyncTime"`
+}
+
+type DroveEventListApiResponse struct {
+	Status    string         `json:"status"`
+	EventList DroveEventList `json:"data"`
+	Message   string         `json:"message"`
+}
+
+func (r *DroveEventListApiResponse) apiStatus() (string, string) { return r.Status, r.Message }
+
+// InstanceChange is the per-instance detail carried by instance events.
+type InstanceChange struct {
+	AppID      string
+	InstanceID string
+	State      string
+	Host       DroveServiceHost
+}
+
+// Healthy reports whether the instance should be served.
+func (ic InstanceChange) Healthy() bool {
+	return ic.State == "HEALTHY"
+}
+
+// instanceChange extracts instance detail from an INSTANCE_STATE_CHANGE event.
+// It returns false if the event lacks the detail needed to patch a snapshot.
+func (e *DroveEvent) instanceChange() (InstanceChange, bool) {
+	if e.Type != "INSTANCE_STATE_CHANGE" {
+		return InstanceChange{}, false
+	}
+	change := InstanceChange{
+		AppID:      metadataString(e.Metadata, "APP_ID"),
+		InstanceID: metadataString(e.Metadata, "INSTANCE_ID"),
+		State:      metadataString(e.Metadata, "CURRENT_STATE"),
+		Host: DroveServiceHost{
+			Host:     metadataString(e.Metadata, "EXECUTOR_HOST"),
+			PortType: metadataString(e.Metadata, "PORT_TYPE"),
+		},
+	}
+	port, ok := e.Metadata["PORT"].(float64)
+	if !ok || change.AppID == "" || change.State == "" || change.Host.Host == "" {
+		return InstanceChange{}, false
+	}
+	change.Host.Port = int32(port)
+	return change, true
+}
+
+func metadataString(metadata map[string]interface{}, key string) string {
+	value, _ := metadata[key].(string)
+	return value
+}
+
+func (r *DroveEventsApiResponse) apiStatus() (string, string) { return r.Status, r.Message }
+
 type LeaderController struct {
 	Endpoint string
 	Host     string
 	Port     int32
+	Term     uint64
 }
 
 type EndpointStatus struct {
-	Endpoint string
-	Healthy  bool
-	Message  string
+	Endpoint     string
+	Healthy      bool
+	Message      string
+	ClaimsLeader bool
+	LeaderHint   string
+
+	successes int
+	failures  int
 }
 
+const (
+	SYNC_RESET_LEADER_CHANGE string = "leader_change"
+	SYNC_RESET_CLOCK         string = "clock_backwards"
+)
+
+// CurrSyncPoint is the event cursor. LastSyncTime comes from the clock of the
+// controller named by Leader and is meaningless to any other controller.
 type CurrSyncPoint struct {
 	sync.RWMutex
 	LastSyncTime int64
+	Leader       string
+	resetPending bool
+}
+
+// advance moves the sync point to syncTime as issued by host. The sync point is
+// reset if host didn't issue the previous sync time or its clock went backwards.
+func (sp *CurrSyncPoint) advance(host string, syncTime int64) {
+	switch {
+	case sp.Leader != "" && sp.Leader != host:
+		log.Warningf("Sync time issued by %s instead of %s, resetting event sync point", host, sp.Leader)
+		sp.reset(SYNC_RESET_LEADER_CHANGE)
+	case syncTime < sp.LastSyncTime:
+		log.Warningf("Sync time of %s went backwards from %d to %d, resetting event sync point", host, sp.LastSyncTime, syncTime)
+		sp.reset(SYNC_RESET_CLOCK)
+	}
+	sp.Leader = host
+	sp.LastSyncTime = syncTime
+}
+
+func (sp *CurrSyncPoint) reset(reason string) {
+	DroveSyncPointResets.WithLabelValues(reason).Inc()
+	sp.LastSyncTime = 0
+	sp.Leader = ""
+	sp.resetPending = true
 }
 
 type DroveAuthConfig struct {
 	User        string
 	Pass        string
 	AccessToken string
+	OAuth2      OAuth2Config
+	// AccessTokenFile, UserFile and PassFile are read again when they change
+	AccessTokenFile string
+	UserFile        string
+	PassFile        string
 }
 
 func (dc DroveAuthConfig) Validate() error {
-	if dc.User == "" && dc.Pass == "" && dc.AccessToken == "" {
-		return fmt.Errorf("User-pass or AccessToken should be set")
+	methods := 0
+	for _, set := range []bool{
+		dc.User != "" || dc.Pass != "",
+		dc.AccessToken != "",
+		dc.OAuth2.enabled(),
+		dc.AccessTokenFile != "",
+		dc.UserFile != "" || dc.PassFile != "",
+	} {
+		if set {
+			methods++
+		}
+	}
+	if methods == 0 {
+		return fmt.Errorf("User-pass, AccessToken or OAuth2 should be set, directly or from files")
+	}
+	if methods > 1 {
+		return fmt.Errorf("Only one of user-pass, access token and oauth2 should be set")
 	}
-	if (dc.Pass != "" || dc.User != "") && dc.AccessToken != "" {
-		return fmt.Errorf("Both user-pass and access token should not be set")
+	if (dc.UserFile == "") != (dc.PassFile == "") {
+		return fmt.Errorf("User and password files should both be set")
+	}
+	if dc.OAuth2.enabled() && (dc.OAuth2.ClientID == "" || dc.OAuth2.ClientSecret == "") {
+		return fmt.Errorf("OAuth2 needs a client id and secret")
 	}
 	return nil
 }
 
 type DroveConfig struct {
-	Endpoint   string
-	AuthConfig DroveAuthConfig
-	SkipSSL    bool
+	Endpoint string
+	// AppsFile serves apps from a file instead of the controllers at Endpoint
+	AppsFile           string
+	AuthConfig         DroveAuthConfig
+	SkipSSL            bool
+	TLS                TLSConfig
+	Transport          TransportConfig
+	HealthyThreshold   int
+	UnhealthyThreshold int
+	Retry              RetryConfig
+	CircuitBreaker     CircuitBreakerConfig
+	SnapshotGuard      SnapshotGuardConfig
+	Sync               SyncConfig
+	Readiness          ReadinessConfig
+	// Zones the plugin is authoritative for, the not ready policy only applies to them
+	Zones []string
+	// PackedResponses answers queries from replies packed once per snapshot
+	PackedResponses bool
+	// ResponseCacheSize is the number of replies cached, 0 disables the cache
+	ResponseCacheSize int
+}
+
+var DEFAULT_RELOAD_EVENTS = []string{"APP_STATE_CHANGE", "INSTANCE_STATE_CHANGE"}
+
+const (
+	EVENT_TRANSPORT_POLL   string = "poll"
+	EVENT_TRANSPORT_EVENTS string = "events"
+	EVENT_TRANSPORT_SSE    string = "sse"
+
+	DEFAULT_EVENT_STREAM_PATH string = "/apis/v1/cluster/events/stream"
+)
+
+type SyncConfig struct {
+	// EventTransport is one of EVENT_TRANSPORT_POLL, EVENT_TRANSPORT_EVENTS or EVENT_TRANSPORT_SSE
+	EventTransport  string
+	EventStreamPath string
+	// ReloadEvents lists the event types triggering a reload, "*" matches any event
+	ReloadEvents        []string
+	ReloadDebounce      time.Duration
+	ReloadMaxDelay      time.Duration
+	EventPollInterval   time.Duration
+	HealthCheckInterval time.Duration
+	RefreshInterval     time.Duration
+	FetchAppsTimeout    time.Duration
+	FetchEventsTimeout  time.Duration
+	PingTimeout         time.Duration
+	// WaitForSync blocks setup up to this long for the first app snapshot, 0 doesn't wait
+	WaitForSync time.Duration
+}
+
+// incremental reports whether the transport patches snapshots from single events.
+func (sc SyncConfig) incremental() bool {
+	return sc.EventTransport == EVENT_TRANSPORT_EVENTS || sc.EventTransport == EVENT_TRANSPORT_SSE
+}
+
+// withDefaults fills unset intervals and timeouts. A zero debounce is kept as it
+// disables debouncing.
+func (sc SyncConfig) withDefaults() SyncConfig {
+	if sc.EventTransport == "" {
+		sc.EventTransport = EVENT_TRANSPORT_POLL
+	}
+	if sc.EventStreamPath == "" {
+		sc.EventStreamPath = DEFAULT_EVENT_STREAM_PATH
+	}
+	if len(sc.ReloadEvents) == 0 {
+		sc.ReloadEvents = DEFAULT_RELOAD_EVENTS
+	}
+	defaults := []struct {
+		value    *time.Duration
+		fallback time.Duration
+	}{
+		{&sc.EventPollInterval, EVENT_POLL_INTERVAL},
+		{&sc.HealthCheckInterval, HEALTH_CHECK_INTERVAL},
+		{&sc.RefreshInterval, REFRESH_INTERVAL},
+		{&sc.FetchAppsTimeout, FETCH_APP_TIMEOUT},
+		{&sc.FetchEventsTimeout, FETCH_EVENTS_TIMEOUT},
+		{&sc.PingTimeout, PING_TIMEOUT},
+	}
+	for _, d := range defaults {
+		if *d.value <= 0 {
+			*d.value = d.fallback
+		}
+	}
+	return sc
+}
+
+func (sc SyncConfig) Validate() error {
+	switch sc.EventTransport {
+	case EVENT_TRANSPORT_POLL, EVENT_TRANSPORT_EVENTS, EVENT_TRANSPORT_SSE:
+	default:
+		return fmt.Errorf("Unknown event transport %s", sc.EventTransport)
+	}
+	if sc.ReloadDebounce < 0 || sc.ReloadMaxDelay < sc.ReloadDebounce {
+		return fmt.Errorf("Reload max delay should not be below the debounce window")
+	}
+	if sc.EventPollInterval <= 0 || sc.HealthCheckInterval <= 0 || sc.RefreshInterval <= 0 {
+		return fmt.Errorf("Sync intervals should be positive")
+	}
+	if sc.FetchAppsTimeout <= 0 || sc.FetchEventsTimeout <= 0 || sc.PingTimeout <= 0 {
+		return fmt.Errorf("Sync timeouts should be positive")
+	}
+	return nil
 }
 
 func (dc DroveConfig) Validate() error {
+	if dc.AppsFile != "" {
+		if dc.Endpoint != "" {
+			return fmt.Errorf("Only one of endpoint and apps file should be set")
+		}
+		if err := dc.Sync.Validate(); err != nil {
+			return err
+		}
+		return dc.Readiness.Validate()
+	}
 	if dc.Endpoint == "" {
 		return fmt.Errorf("Endpoint Cant be empty")
 	}
+	if dc.HealthyThreshold < 1 || dc.UnhealthyThreshold < 1 {
+		return fmt.Errorf("Health check thresholds should be at least 1")
+	}
+	if dc.Retry.Attempts < 1 || dc.Retry.BaseBackoff <= 0 || dc.Retry.MaxBackoff < dc.Retry.BaseBackoff {
+		return fmt.Errorf("Retry needs at least 1 attempt and a max backoff not below the base backoff")
+	}
+	if dc.CircuitBreaker.Failures < 1 || dc.CircuitBreaker.Cooldown <= 0 {
+		return fmt.Errorf("Circuit breaker needs at least 1 failure and a positive cooldown")
+	}
+	if err := dc.Sync.Validate(); err != nil {
+		return err
+	}
+	if err := dc.Readiness.Validate(); err != nil {
+		return err
+	}
+	if err := dc.TLS.Validate(); err != nil {
+		return err
+	}
+	if err := dc.Transport.Validate(); err != nil {
+		return err
+	}
 	return dc.AuthConfig.Validate()
 }
 
 func NewDroveConfig() DroveConfig {
-	return DroveConfig{SkipSSL: false, AuthConfig: DroveAuthConfig{}}
+	return DroveConfig{
+		SkipSSL:            false,
+		AuthConfig:         DroveAuthConfig{},
+		HealthyThreshold:   1,
+		UnhealthyThreshold: 1,
+		Retry: RetryConfig{
+			Attempts:    DEFAULT_RETRY_ATTEMPTS,
+			BaseBackoff: DEFAULT_RETRY_BASE_BACKOFF,
+			MaxBackoff:  DEFAULT_RETRY_MAX_BACKOFF,
+		},
+		CircuitBreaker: CircuitBreakerConfig{
+			Failures: DEFAULT_CIRCUIT_BREAKER_FAILURES,
+			Cooldown: DEFAULT_CIRCUIT_BREAKER_COOLDOWN,
+		},
+		SnapshotGuard: SnapshotGuardConfig{OverrideAfter: DEFAULT_GUARD_OVERRIDE_AFTER},
+		Readiness:     ReadinessConfig{NotReady: NOT_READY_SERVFAIL},
+		Sync: SyncConfig{
+			EventTransport:      EVENT_TRANSPORT_POLL,
+			EventStreamPath:     DEFAULT_EVENT_STREAM_PATH,
+			ReloadEvents:        DEFAULT_RELOAD_EVENTS,
+			ReloadDebounce:      DEFAULT_RELOAD_DEBOUNCE,
+			ReloadMaxDelay:      DEFAULT_RELOAD_MAX_DELAY,
+			EventPollInterval:   EVENT_POLL_INTERVAL,
+			HealthCheckInterval: HEALTH_CHECK_INTERVAL,
+			RefreshInterval:     REFRESH_INTERVAL,
+			FetchAppsTimeout:    FETCH_APP_TIMEOUT,
+			FetchEventsTimeout:  FETCH_EVENTS_TIMEOUT,
+			PingTimeout:         PING_TIMEOUT,
+		},
+	}
 }
@@ -0,0 +1,210 @@
+package drovedns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+)
+
+// OAUTH2_REFRESH_BEFORE is how long before expiry a token is replaced, so
+// requests in flight never carry an expired token.
+const OAUTH2_REFRESH_BEFORE time.Duration = time.Duration(30) * time.Second
+
+// OAuth2Config configures the OAuth2 client credentials flow.
+type OAuth2Config struct {
+	TokenURL     string
+	ClientID     string
+	ClientSecret string
+	Scopes       []string
+}
+
+func (oc OAuth2Config) enabled() bool {
+	return oc.TokenURL != ""
+}
+
+// tokenCache fetches client credentials tokens and reuses them until shortly
+// before they expire.
+type tokenCache struct {
+	mutex  sync.Mutex
+	config clientcredentials.Config
+	client *http.Client
+	token  *oauth2.Token
+}
+
+func newTokenCache(config OAuth2Config, client *http.Client) *tokenCache {
+	return &tokenCache{
+		config: clientcredentials.Config{
+			ClientID:     config.ClientID,
+			ClientSecret: config.ClientSecret,
+			TokenURL:     config.TokenURL,
+			Scopes:       config.Scopes,
+		},
+		client: client,
+	}
+}
+
+func (tc *tokenCache) Token(ctx context.Context) (*oauth2.Token, error) {
+	tc.mutex.Lock()
+	defer tc.mutex.Unlock()
+	if tc.token != nil && (tc.token.Expiry.IsZero() || time.Until(tc.token.Expiry) > OAUTH2_REFRESH_BEFORE) {
+		return tc.token, nil
+	}
+	token, err := tc.config.Token(context.WithValue(ctx, oauth2.HTTPClient, tc.client))
+	if err != nil {
+		DroveTokenRefreshes.WithLabelValues("failure").Inc()
+		return nil, err
+	}
+	DroveTokenRefreshes.WithLabelValues("success").Inc()
+	log.Debugf("Fetched oauth2 token expiring at %s", token.Expiry)
+	tc.token = token
+	return token, nil
+}
+
+// invalidate drops token if it is still the cached one, so concurrent requests
+// rejected with the same token only trigger a single refresh.
+func (tc *tokenCache) invalidate(token *oauth2.Token) {
+	tc.mutex.Lock()
+	defer tc.mutex.Unlock()
+	if tc.token == token {
+		tc.token = nil
+	}
+}
+
+// tokenError tells a rejection by the token endpoint apart from failing to
+// reach it.
+func tokenError(tokenURL string, err error) *DroveApiError {
+	var retrieveErr *oauth2.RetrieveError
+	if !errors.As(err, &retrieveErr) || retrieveErr.Response == nil {
+		return &DroveApiError{Kind: ApiErrorTransport, Host: tokenURL, Err: err}
+	}
+	kind := ApiErrorAuth
+	if retrieveErr.Response.StatusCode >= 500 {
+		kind = ApiErrorServer
+	}
+	return &DroveApiError{Kind: kind, Host: tokenURL, StatusCode: retrieveErr.Response.StatusCode, Err: err}
+}
+
+// credentialFile holds a secret read from a file. The file is read again once
+// its modification time or size changes, as happens on secret rotation.
+type credentialFile struct {
+	path    string
+	mutex   sync.Mutex
+	modTime time.Time
+	size    int64
+	value   string
+}
+
+func newCredentialFile(path string) *credentialFile {
+	if path == "" {
+		return nil
+	}
+	return &credentialFile{path: path}
+}
+
+// load returns the current content of the file. If the file can't be read the
+// last value read is kept.
+func (cf *credentialFile) load() (string, error) {
+	cf.mutex.Lock()
+	defer cf.mutex.Unlock()
+	info, err := os.Stat(cf.path)
+	if err == nil && info.ModTime().Equal(cf.modTime) && info.Size() == cf.size {
+		return cf.value, nil
+	}
+	var content []byte
+	if err == nil {
+		content, err = os.ReadFile(cf.path)
+	}
+	if err != nil {
+		if cf.value != "" {
+			log.Warningf("Unable to reload credentials from %s, keeping previous value: %v", cf.path, err)
+			return cf.value, nil
+		}
+		return "", err
+	}
+	if cf.value != "" {
+		log.Infof("Reloaded credentials from %s", cf.path)
+	}
+	DroveCredentialReloads.WithLabelValues(cf.path).Inc()
+	cf.modTime, cf.size = info.ModTime(), info.Size()
+	cf.value = strings.TrimSpace(string(content))
+	return cf.value, nil
+}
+
+// credentials returns the static credentials, reading file based ones.
+func (c *DroveClient) credentials() (DroveAuthConfig, error) {
+	config := *c.AuthConfig
+	files := []struct {
+		file  *credentialFile
+		value *string
+	}{
+		{c.accessTokenFile, &config.AccessToken},
+		{c.userFile, &config.User},
+		{c.passFile, &config.Pass},
+	}
+	for _, f := range files {
+		if f.file == nil {
+			continue
+		}
+		value, err := f.file.load()
+		if err != nil {
+			return config, &DroveApiError{Kind: ApiErrorAuth, Message: fmt.Sprintf("credentials file %s", f.file.path), Err: err}
+		}
+		*f.value = value
+	}
+	return config, nil
+}
+
+// authorize sets the headers of req, returning the oauth2 token used if any.
+func (c *DroveClient) authorize(req *http.Request) (*oauth2.Token, error) {
+	if req.Header.Get("Accept") == "" {
+		req.Header.Set("Accept", "application/json")
+	}
+	config, err := c.credentials()
+	if err != nil {
+		return nil, err
+	}
+	if config.User != "" {
+		req.SetBasicAuth(config.User, config.Pass)
+	}
+	if config.AccessToken != "" {
+		req.Header.Set("Authorization", config.AccessToken)
+	}
+	if c.tokens == nil {
+		return nil, nil
+	}
+	token, err := c.tokens.Token(req.Context())
+	if err != nil {
+		return nil, tokenError(config.OAuth2.TokenURL, err)
+	}
+	token.SetAuthHeader(req)
+	return token, nil
+}
+
+// send authorizes and executes req. A request rejected with 401 is retried once
+// with a freshly fetched oauth2 token.
+func (c *DroveClient) send(req *http.Request) (*http.Response, error) {
+	token, err := c.authorize(req)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil || token == nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	resp.Body.Close()
+	log.Warningf("Token rejected by %s, fetching a new one", req.URL.Host)
+	c.tokens.invalidate(token)
+	retry := req.Clone(req.Context())
+	if _, err := c.authorize(retry); err != nil {
+		return nil, err
+	}
+	return c.client.Do(retry)
+}
@@ -0,0 +1,116 @@
+package drovedns
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Backend is a source of app snapshots for DroveEndpoints.
+type Backend interface {
+	// FetchApps returns the complete current snapshot. It may return the previous
+	// snapshot along with ErrNotModified if nothing changed since the last call.
+	FetchApps() (*DroveAppsResponse, error)
+	// Watch starts delivering change notifications to listener and returns
+	// immediately
+	Watch(listener BackendListener)
+	// Healthy reports whether snapshots can currently be fetched
+	Healthy() bool
+	// Stop ends watching for changes
+	Stop()
+}
+
+// BackendListener receives change notifications from a Backend.
+type BackendListener struct {
+	// Changed asks for the snapshot to be fetched again
+	Changed func()
+	// Events delivers drove events in the order received, which may patch the
+	// snapshot in place. Events received together are delivered in one call.
+	Events func(events []*DroveEvent)
+}
+
+// droveBackend serves snapshots from the drove controllers.
+type droveBackend struct {
+	client   IDroveClient
+	sync     SyncConfig
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+func newDroveBackend(client IDroveClient, config SyncConfig) *droveBackend {
+	return &droveBackend{client: client, sync: config, done: make(chan struct{})}
+}
+
+func (b *droveBackend) FetchApps() (*DroveAppsResponse, error) {
+	return b.client.FetchApps()
+}
+
+func (b *droveBackend) Healthy() bool {
+	return b.client.Healthy()
+}
+
+func (b *droveBackend) Stop() {
+	b.stopOnce.Do(func() {
+		close(b.done)
+		b.client.Stop()
+	})
+}
+
+// Watch delivers drove events according to the configured transport. The
+// stream falls back to polling the event summary if the controller doesn't
+// support streaming.
+func (b *droveBackend) Watch(listener BackendListener) {
+	onSummary := func(eventSummary *DroveEventSummary) {
+		if eventType, ok := reloadEvent(eventSummary, b.sync.ReloadEvents); ok {
+			log.Debugf("%s %+v", eventType, eventSummary.EventsCount[eventType])
+			listener.Changed()
+		}
+	}
+	switch b.sync.EventTransport {
+	case EVENT_TRANSPORT_POLL:
+		b.client.PollEvents(onSummary, listener.Changed)
+		return
+	case EVENT_TRANSPORT_EVENTS:
+		b.client.PollEventDetails(func(events []*DroveEvent) {
+			listener.Events(events)
+			if len(events) >= EVENTS_PAGE_SIZE {
+				log.Warningf("Received a full page of %d events, some may be missing", len(events))
+				listener.Changed()
+			}
+		}, listener.Changed)
+		return
+	}
+	onEvent := func(event *DroveEvent) {
+		listener.Events([]*DroveEvent{event})
+	}
+	go func() {
+		backoff := RetryConfig{BaseBackoff: time.Second, MaxBackoff: 30 * time.Second}.withDefaults()
+		failures := 0
+		for {
+			connected := time.Now()
+			err := b.client.StreamEvents(onEvent)
+			if errors.Is(err, ErrStreamUnsupported) {
+				log.Warningf("Event streaming unavailable, falling back to polling the event summary: %v", err)
+				b.client.PollEvents(onSummary, listener.Changed)
+				return
+			}
+			if time.Since(connected) > backoff.MaxBackoff {
+				failures = 0
+			}
+			failures++
+			select {
+			case <-b.done:
+				return
+			default:
+			}
+			log.Warningf("Event stream disconnected: %v", err)
+			select {
+			case <-b.done:
+				return
+			case <-time.After(backoff.backoff(failures)):
+			}
+			// Events may have been missed while disconnected
+			listener.Changed()
+		}
+	}()
+}
@@ -0,0 +1,131 @@
+package drovedns
+
+import (
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const DEFAULT_RESPONSE_CACHE_SIZE int = 10000
+
+type responseCacheKey struct {
+	name   string
+	qtype  uint16
+	qclass uint16
+	do     bool
+	cd     bool
+}
+
+func newResponseCacheKey(r *dns.Msg) responseCacheKey {
+	question := r.Question[0]
+	key := responseCacheKey{name: question.Name, qtype: question.Qtype, qclass: question.Qclass, cd: r.CheckingDisabled}
+	if opt := r.IsEdns0(); opt != nil {
+		key.do = opt.Do()
+	}
+	return key
+}
+
+type cachedResponse struct {
+	msg *dns.Msg
+	// generation of the vhost the response was built from
+	generation uint64
+	expires    time.Time
+}
+
+// responseCache holds replies to queries for vhosts, including the answers of
+// the next plugin combined with them. An entry is only served while the hosts
+// of its vhost are unchanged, so it never outlives the snapshot it was built from.
+type responseCache struct {
+	mutex    sync.RWMutex
+	capacity int
+	entries  map[responseCacheKey]*cachedResponse
+}
+
+func newResponseCache(capacity int) *responseCache {
+	return &responseCache{capacity: capacity, entries: make(map[responseCacheKey]*cachedResponse)}
+}
+
+// get returns a copy of the cached reply to r if it was built from generation
+// of the vhost queried. Writers truncate, extend and modify it in place.
+func (c *responseCache) get(r *dns.Msg, generation uint64) *dns.Msg {
+	key := newResponseCacheKey(r)
+	c.mutex.RLock()
+	entry, ok := c.entries[key]
+	c.mutex.RUnlock()
+	if !ok {
+		DroveResponseCacheRequests.WithLabelValues("miss").Inc()
+		return nil
+	}
+	if entry.generation != generation || time.Now().After(entry.expires) {
+		DroveResponseCacheRequests.WithLabelValues("stale").Inc()
+		c.mutex.Lock()
+		if c.entries[key] == entry {
+			delete(c.entries, key)
+		}
+		c.mutex.Unlock()
+		return nil
+	}
+	DroveResponseCacheRequests.WithLabelValues("hit").Inc()
+	reply := entry.msg.Copy()
+	reply.Id = r.Id
+	reply.RecursionDesired = r.RecursionDesired
+	return reply
+}
+
+// put caches res as the reply to r. Only complete, successful replies are
+// cached, for no longer than the smallest TTL they carry. res must not be
+// modified afterwards.
+func (c *responseCache) put(r *dns.Msg, res *dns.Msg, generation uint64) {
+	if res.Rcode != dns.RcodeSuccess || res.Truncated {
+		return
+	}
+	ttl, ok := minTTL(res)
+	if !ok {
+		return
+	}
+	entry := &cachedResponse{msg: res, generation: generation, expires: time.Now().Add(time.Duration(ttl) * time.Second)}
+	key := newResponseCacheKey(r)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.capacity {
+		// Evict a random entry, map iteration order is unspecified
+		for evicted := range c.entries {
+			delete(c.entries, evicted)
+			break
+		}
+	}
+	c.entries[key] = entry
+}
+
+// invalidate drops the entries of vhosts. Entries of changed vhosts would not
+// be served anyway, this only frees them early.
+func (c *responseCache) invalidate(vhosts []string) {
+	changed := make(map[string]bool, len(vhosts))
+	for _, vhost := range vhosts {
+		changed[vhost] = true
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for key := range c.entries {
+		if changed[key.name] {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// minTTL returns the smallest TTL of the records in res, capped at SRV_TTL.
+func minTTL(res *dns.Msg) (uint32, bool) {
+	ttl := SRV_TTL
+	for _, section := range [][]dns.RR{res.Answer, res.Ns, res.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			if rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+			}
+		}
+	}
+	return ttl, ttl > 0
+}
@@ -0,0 +1,66 @@
+package drovedns
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// responseValidators are the ETag and Last-Modified headers of the last
+// response of a controller, used to make the next request conditional.
+type responseValidators struct {
+	host         string
+	etag         string
+	lastModified string
+}
+
+// apply adds the validators to req if they were issued by host. A nil
+// receiver makes the request unconditional.
+func (v *responseValidators) apply(host string, req *http.Request) {
+	if v == nil || v.host != host {
+		return
+	}
+	if v.etag != "" {
+		req.Header.Set("If-None-Match", v.etag)
+	}
+	if v.lastModified != "" {
+		req.Header.Set("If-Modified-Since", v.lastModified)
+	}
+}
+
+func (v *responseValidators) update(host string, resp *http.Response) {
+	if v == nil {
+		return
+	}
+	v.host = host
+	v.etag = resp.Header.Get("ETag")
+	v.lastModified = resp.Header.Get("Last-Modified")
+}
+
+// appsCache keeps the last apps response with its validators, to be returned
+// again when the leader reports it unchanged.
+type appsCache struct {
+	sync.Mutex
+	validators responseValidators
+	apps       *DroveAppsResponse
+}
+
+type countingReader struct {
+	reader io.Reader
+	count  int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.count += int64(n)
+	return n, err
+}
+
+// apiPath strips the query from path to keep metric cardinality low.
+func apiPath(path string) string {
+	if i := strings.IndexByte(path, '?'); i >= 0 {
+		return path[:i]
+	}
+	return path
+}
@@ -0,0 +1,80 @@
+package drovedns
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// streamDecoder is implemented by responses decoding themselves token by token
+// instead of buffering the whole document.
+type streamDecoder interface {
+	decodeStream(decoder *json.Decoder) error
+}
+
+// decodeStream reads the apps response one app at a time, building the vhost
+// index along the way. Unlike Decode it buffers a single app rather than the
+// whole document, and the index shares hosts and tags with Apps instead of
+// being built in a second pass. This saves memory, not time: each app is still
+// scanned and unmarshalled like Decode does.
+func (r *DroveAppsResponse) decodeStream(decoder *json.Decoder) error {
+	if err := expectDelim(decoder, '{'); err != nil {
+		return err
+	}
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return err
+		}
+		// Keys match case-insensitively, as they do for Decode
+		key, _ := token.(string)
+		switch {
+		case strings.EqualFold(key, "status"):
+			err = decoder.Decode(&r.Status)
+		case strings.EqualFold(key, "message"):
+			err = decoder.Decode(&r.Message)
+		case strings.EqualFold(key, "data"):
+			err = r.decodeApps(decoder)
+		default:
+			var skip json.RawMessage
+			err = decoder.Decode(&skip)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return expectDelim(decoder, '}')
+}
+
+func (r *DroveAppsResponse) decodeApps(decoder *json.Decoder) error {
+	token, err := decoder.Token()
+	if err != nil || token == nil {
+		return err
+	}
+	if token != json.Delim('[') {
+		return fmt.Errorf("expected apps array, got %v", token)
+	}
+	r.Apps = nil
+	r.byVhost = make(map[string]DroveApp)
+	for decoder.More() {
+		// Decoded in place, a local app would escape to the heap once per app
+		r.Apps = append(r.Apps, DroveApp{})
+		app := &r.Apps[len(r.Apps)-1]
+		if err := decoder.Decode(app); err != nil {
+			return err
+		}
+		r.byVhost[app.Vhost+"."] = *app
+	}
+	return expectDelim(decoder, ']')
+}
+
+func expectDelim(decoder *json.Decoder, delim json.Delim) error {
+	token, err := decoder.Token()
+	if err != nil {
+		return err
+	}
+	if token != delim {
+		return fmt.Errorf("expected %v, got %v", delim, token)
+	}
+	return nil
+}
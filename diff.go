@@ -0,0 +1,118 @@
+package drovedns
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const MAX_LOGGED_VHOSTS int = 10
+
+// VhostDiff lists the hosts added to and removed from a single vhost.
+type VhostDiff struct {
+	Vhost        string
+	HostsAdded   []DroveServiceHost
+	HostsRemoved []DroveServiceHost
+}
+
+// SnapshotDiff describes what changed between two app snapshots. Vhosts lists
+// every vhost whose hosts changed, including added and removed apps.
+type SnapshotDiff struct {
+	AppsAdded   []string
+	AppsRemoved []string
+	Vhosts      []VhostDiff
+}
+
+func (d SnapshotDiff) Empty() bool {
+	return len(d.AppsAdded) == 0 && len(d.AppsRemoved) == 0 && len(d.Vhosts) == 0
+}
+
+func (d SnapshotDiff) HostsAdded() int {
+	count := 0
+	for _, v := range d.Vhosts {
+		count += len(v.HostsAdded)
+	}
+	return count
+}
+
+func (d SnapshotDiff) HostsRemoved() int {
+	count := 0
+	for _, v := range d.Vhosts {
+		count += len(v.HostsRemoved)
+	}
+	return count
+}
+
+// ChangedVhosts returns every vhost touched by the diff.
+func (d SnapshotDiff) ChangedVhosts() []string {
+	vhosts := make([]string, len(d.Vhosts))
+	for i, v := range d.Vhosts {
+		vhosts[i] = v.Vhost
+	}
+	return vhosts
+}
+
+func (d SnapshotDiff) String() string {
+	return fmt.Sprintf("apps added %d %s, apps removed %d %s, hosts added %d, hosts removed %d across %d vhosts %s",
+		len(d.AppsAdded), truncatedList(d.AppsAdded), len(d.AppsRemoved), truncatedList(d.AppsRemoved),
+		d.HostsAdded(), d.HostsRemoved(), len(d.Vhosts), truncatedList(d.ChangedVhosts()))
+}
+
+func truncatedList(items []string) string {
+	if len(items) > MAX_LOGGED_VHOSTS {
+		return fmt.Sprintf("[%s ...]", strings.Join(items[:MAX_LOGGED_VHOSTS], " "))
+	}
+	return fmt.Sprintf("%v", items)
+}
+
+// diffApps compares two vhost indexes. The result is sorted by vhost so it is
+// stable for logging and tests.
+func diffApps(prev map[string]DroveApp, next map[string]DroveApp) SnapshotDiff {
+	diff := SnapshotDiff{}
+	for vhost, app := range prev {
+		nextApp, ok := next[vhost]
+		if !ok {
+			diff.AppsRemoved = append(diff.AppsRemoved, vhost)
+			diff.Vhosts = append(diff.Vhosts, VhostDiff{Vhost: vhost, HostsRemoved: app.Hosts})
+			continue
+		}
+		added, removed := diffHosts(app.Hosts, nextApp.Hosts)
+		if len(added) > 0 || len(removed) > 0 {
+			diff.Vhosts = append(diff.Vhosts, VhostDiff{Vhost: vhost, HostsAdded: added, HostsRemoved: removed})
+		}
+	}
+	for vhost, app := range next {
+		if _, ok := prev[vhost]; !ok {
+			diff.AppsAdded = append(diff.AppsAdded, vhost)
+			diff.Vhosts = append(diff.Vhosts, VhostDiff{Vhost: vhost, HostsAdded: app.Hosts})
+		}
+	}
+	sort.Strings(diff.AppsAdded)
+	sort.Strings(diff.AppsRemoved)
+	sort.Slice(diff.Vhosts, func(i, j int) bool { return diff.Vhosts[i].Vhost < diff.Vhosts[j].Vhost })
+	return diff
+}
+
+func diffHosts(prev []DroveServiceHost, next []DroveServiceHost) (added []DroveServiceHost, removed []DroveServiceHost) {
+	if len(prev) == len(next) && (len(prev) == 0 || &prev[0] == &next[0]) {
+		// Patched snapshots share the hosts of untouched apps
+		return nil, nil
+	}
+	prevKeys := make(map[string]bool, len(prev))
+	for _, h := range prev {
+		prevKeys[hostKey(h)] = true
+	}
+	nextKeys := make(map[string]bool, len(next))
+	for _, h := range next {
+		nextKeys[hostKey(h)] = true
+		if !prevKeys[hostKey(h)] {
+			added = append(added, h)
+		}
+	}
+	for _, h := range prev {
+		if !nextKeys[hostKey(h)] {
+			removed = append(removed, h)
+		}
+	}
+	return added, removed
+}
@@ -1,46 +1,86 @@
 package drovedns
 
 import (
+	"compress/gzip"
 	"context"
-	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// Defaults for the timeouts and intervals configurable in SyncConfig
 const (
 	FETCH_APP_TIMEOUT    time.Duration = time.Duration(5) * time.Second
 	FETCH_EVENTS_TIMEOUT time.Duration = time.Duration(5) * time.Second
 	PING_TIMEOUT         time.Duration = time.Duration(5) * time.Second
+
+	HEALTH_CHECK_INTERVAL time.Duration = time.Duration(2) * time.Second
+	EVENT_POLL_INTERVAL   time.Duration = time.Duration(2) * time.Second
+	REFRESH_INTERVAL      time.Duration = time.Duration(10) * time.Second
+
+	DEFAULT_WAIT_FOR_SYNC_TIMEOUT time.Duration = time.Duration(30) * time.Second
+
+	EVENTS_PAGE_SIZE int = 1024
+	// HEALTH_CHECK_JITTER spreads health checks of multiple coredns replicas
+	// so they don't hit the controllers in lockstep.
+	HEALTH_CHECK_JITTER float64 = 0.2
 )
 
 type IDroveClient interface {
 	FetchApps() (*DroveAppsResponse, error)
 	FetchRecentEvents(syncPoint *CurrSyncPoint) (*DroveEventSummary, error)
-	PollEvents(callback func(event *DroveEventSummary))
+	PollEvents(callback func(event *DroveEventSummary), resync func())
+	PollEventDetails(callback func(events []*DroveEvent), resync func())
+	StreamEvents(callback func(event *DroveEvent)) error
+	Healthy() bool
+	// Stop ends health checks and event polling
+	Stop()
+}
+
+// controllerState is an immutable view of controller health and the elected leader.
+// It is replaced as a whole after every health check and never modified in place.
+type controllerState struct {
+	endpoints []EndpointStatus
+	leader    *LeaderController
 }
+
 type DroveClient struct {
-	EndpointMutex sync.RWMutex
-	Endpoint      []EndpointStatus
-	Leader        *LeaderController
-	AuthConfig    *DroveAuthConfig
-	client        *http.Client
+	AuthConfig         *DroveAuthConfig
+	tokens             *tokenCache
+	accessTokenFile    *credentialFile
+	userFile           *credentialFile
+	passFile           *credentialFile
+	appsCache          *appsCache
+	client             *http.Client
+	controllers        []string
+	state              atomic.Pointer[controllerState]
+	healthMutex        sync.Mutex
+	healthyThreshold   int
+	unhealthyThreshold int
+	retry              RetryConfig
+	breakers           map[string]*circuitBreaker
+	sync               SyncConfig
+	// done is closed by Stop
+	done     chan struct{}
+	stopOnce sync.Once
 }
 
-func NewDroveClient(config DroveConfig) DroveClient {
+func NewDroveClient(config DroveConfig) *DroveClient {
 	controllerEndpoints := strings.Split(config.Endpoint, ",")
 	endpoints := make([]EndpointStatus, len(controllerEndpoints))
 	for i, e := range controllerEndpoints {
-		endpoints[i] = EndpointStatus{e, true, ""}
+		endpoints[i] = EndpointStatus{Endpoint: e, Healthy: true}
 	}
-	tr := &http.Transport{MaxIdleConnsPerHost: 10, TLSClientConfig: &tls.Config{InsecureSkipVerify: config.SkipSSL}}
+	tr := newTransport(config)
 	httpClient := &http.Client{
 		Timeout:   0 * time.Second,
 		Transport: tr,
@@ -48,7 +88,35 @@ func NewDroveClient(config DroveConfig) DroveClient {
 			return http.ErrUseLastResponse
 		},
 	}
-	return DroveClient{Endpoint: endpoints, AuthConfig: &config.AuthConfig, client: httpClient}
+	c := &DroveClient{
+		AuthConfig:         &config.AuthConfig,
+		client:             httpClient,
+		controllers:        controllerEndpoints,
+		healthyThreshold:   atLeastOne(config.HealthyThreshold),
+		unhealthyThreshold: atLeastOne(config.UnhealthyThreshold),
+		retry:              config.Retry.withDefaults(),
+		sync:               config.Sync.withDefaults(),
+		breakers:           make(map[string]*circuitBreaker, len(controllerEndpoints)),
+		accessTokenFile:    newCredentialFile(config.AuthConfig.AccessTokenFile),
+		userFile:           newCredentialFile(config.AuthConfig.UserFile),
+		passFile:           newCredentialFile(config.AuthConfig.PassFile),
+		appsCache:          &appsCache{},
+		done:               make(chan struct{}),
+	}
+	breakerConfig := config.CircuitBreaker.withDefaults()
+	for _, e := range controllerEndpoints {
+		c.breakers[e] = newCircuitBreaker(e, breakerConfig)
+	}
+	if config.AuthConfig.OAuth2.enabled() {
+		c.tokens = newTokenCache(config.AuthConfig.OAuth2, &http.Client{Transport: tr})
+	}
+	c.state.Store(&controllerState{endpoints: endpoints})
+	return c
+}
+
+// Stop ends the health checks, event polling and streaming of the client.
+func (c *DroveClient) Stop() {
+	c.stopOnce.Do(func() { close(c.done) })
 }
 
 func (c *DroveClient) Init() error {
@@ -57,11 +125,81 @@ func (c *DroveClient) Init() error {
 	_, err := c.endpoint()
 	return err
 }
-func (c *DroveClient) getRequest(path string, timeout time.Duration, obj any) error {
-	host, err := c.endpoint()
-	if err != nil {
-		return err
+
+// getRequest calls the leader, retrying with backoff. Every attempt re-resolves
+// the leader and falls over to other healthy controllers once it was tried.
+// It returns the controller that answered. With validators set the request is
+// conditional and ErrNotModified is returned if the response didn't change.
+func (c *DroveClient) getRequest(path string, timeout time.Duration, obj any, validators *responseValidators) (string, error) {
+	var lastErr error
+	tried := make(map[string]bool)
+	for attempt := 0; attempt < c.retry.Attempts; attempt++ {
+		if attempt > 0 {
+			DroveApiRetries.Inc()
+			time.Sleep(c.retry.backoff(attempt))
+		}
+		host, err := c.nextEndpoint(tried)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		tried[host] = true
+		err = c.doGetRequest(host, path, timeout, obj, validators)
+		if err == nil || errors.Is(err, ErrNotModified) {
+			c.breakers[host].record(nil)
+			return host, err
+		}
+		DroveApiErrors.WithLabelValues(apiErrorKind(err), host).Inc()
+		lastErr = err
+		if !isRetryable(err) {
+			log.Errorf("Request to %s%s failed: %v", host, path, err)
+			return "", err
+		}
+		// A follower answering is up, only the leader moved
+		if !errors.Is(err, ErrNotLeader) {
+			c.breakers[host].record(err)
+		}
+		log.Warningf("Request to %s%s failed on attempt %d/%d: %v", host, path, attempt+1, c.retry.Attempts, err)
+	}
+	return "", lastErr
+}
+
+// nextEndpoint returns the leader if it was not tried yet, then any other healthy
+// controller. Controllers with an open circuit are skipped.
+func (c *DroveClient) nextEndpoint(tried map[string]bool) (string, error) {
+	state := c.state.Load()
+	candidates := make([]string, 0, len(state.endpoints)+1)
+	if state.leader != nil {
+		candidates = append(candidates, state.leader.Endpoint)
+	}
+	for _, es := range state.endpoints {
+		if es.Healthy {
+			candidates = append(candidates, es.Endpoint)
+		}
+	}
+	if len(candidates) == 0 {
+		return "", errors.New("all endpoints are down")
 	}
+	fallback := ""
+	for _, candidate := range candidates {
+		breaker, ok := c.breakers[candidate]
+		if ok && !breaker.allow() {
+			continue
+		}
+		if !tried[candidate] {
+			return candidate, nil
+		}
+		if fallback == "" {
+			fallback = candidate
+		}
+	}
+	if fallback == "" {
+		return "", errors.New("circuit open for all controllers")
+	}
+	return fallback, nil
+}
+
+func (c *DroveClient) doGetRequest(host string, path string, timeout time.Duration, obj any, validators *responseValidators) error {
 	endpoint := host + path
 	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
@@ -70,81 +208,166 @@ func (c *DroveClient) getRequest(path string, timeout time.Duration, obj any) er
 		return err
 	}
 
-	setHeaders(*c.AuthConfig, req)
-	resp, err := c.client.Do(req)
+	// Set explicitly, so the transport leaves the body compressed and the size
+	// on the wire can be measured
+	req.Header.Set("Accept-Encoding", "gzip")
+	validators.apply(host, req)
+	resp, err := c.send(req)
 	if err != nil {
 		DroveApiRequests.WithLabelValues("err", "GET", host).Inc()
-		return err
+		return transportError(host, path, err)
 	}
 	DroveApiRequests.WithLabelValues(strconv.Itoa(resp.StatusCode), "GET", host).Inc()
 	defer resp.Body.Close()
-	decoder := json.NewDecoder(resp.Body)
+	if resp.StatusCode == http.StatusNotModified && validators != nil {
+		return ErrNotModified
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return &DroveApiError{Kind: statusErrorKind(resp.StatusCode), Host: host, Path: path, StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(body))}
+	}
+	body := &countingReader{reader: resp.Body}
+	var reader io.Reader = body
+	if resp.Header.Get("Content-Encoding") == "gzip" {
+		gzipReader, err := gzip.NewReader(body)
+		if err != nil {
+			return &DroveApiError{Kind: ApiErrorDecode, Host: host, Path: path, StatusCode: resp.StatusCode, Err: err}
+		}
+		defer gzipReader.Close()
+		reader = gzipReader
+	}
+	decoder := json.NewDecoder(reader)
 
-	err = decoder.Decode(obj)
+	start := time.Now()
+	if stream, ok := obj.(streamDecoder); ok {
+		err = stream.decodeStream(decoder)
+	} else {
+		err = decoder.Decode(obj)
+	}
+	api := apiPath(path)
+	DroveDecodeDuration.WithLabelValues(api).Observe(time.Since(start).Seconds())
+	DroveResponseSize.WithLabelValues(api).Observe(float64(body.count))
 	if err != nil {
-		return err
+		return &DroveApiError{Kind: ApiErrorDecode, Host: host, Path: path, StatusCode: resp.StatusCode, Err: err}
+	}
+	validators.update(host, resp)
+	if apiResp, ok := obj.(apiResponse); ok {
+		if status, message := apiResp.apiStatus(); status != "SUCCESS" {
+			return &DroveApiError{Kind: ApiErrorApiStatus, Host: host, Path: path, StatusCode: resp.StatusCode, Message: fmt.Sprintf("status %q %s", status, message)}
+		}
 	}
 	return nil
 }
 
+// FetchApps returns all apps. If the leader reports them unchanged since the
+// last fetch, that response is returned again along with ErrNotModified.
 func (c *DroveClient) FetchApps() (*DroveAppsResponse, error) {
-
+	c.appsCache.Lock()
+	defer c.appsCache.Unlock()
 	jsonapps := &DroveAppsResponse{}
-	err := c.getRequest("/apis/v1/endpoints", FETCH_APP_TIMEOUT, jsonapps)
-	return jsonapps, err
-
+	validators := c.appsCache.validators
+	_, err := c.getRequest("/apis/v1/endpoints", c.sync.FetchAppsTimeout, jsonapps, &validators)
+	if errors.Is(err, ErrNotModified) {
+		return c.appsCache.apps, ErrNotModified
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.appsCache.validators, c.appsCache.apps = validators, jsonapps
+	return jsonapps, nil
 }
 
 func (c *DroveClient) FetchRecentEvents(syncPoint *CurrSyncPoint) (*DroveEventSummary, error) {
 
 	var newEventsApiResponse = DroveEventsApiResponse{}
-	err := c.getRequest("/apis/v1/cluster/events/summary?lastSyncTime="+fmt.Sprint(syncPoint.LastSyncTime), FETCH_EVENTS_TIMEOUT, &newEventsApiResponse)
+	host, err := c.getRequest("/apis/v1/cluster/events/summary?lastSyncTime="+fmt.Sprint(syncPoint.LastSyncTime), c.sync.FetchEventsTimeout, &newEventsApiResponse, nil)
 	if err != nil {
 		return nil, err
 	}
 
 	log.Debugf("events response %+v", newEventsApiResponse)
-	if newEventsApiResponse.Status != "SUCCESS" {
-		return nil, errors.New("Events api call failed. Message: " + newEventsApiResponse.Message)
-	}
 
-	syncPoint.LastSyncTime = newEventsApiResponse.EventSummary.LastSyncTime
+	syncPoint.advance(host, newEventsApiResponse.EventSummary.LastSyncTime)
 	return &(newEventsApiResponse.EventSummary), nil
 }
 
-func (c *DroveClient) PollEvents(callback func(event *DroveEventSummary)) {
+// FetchEvents returns the events that happened after the sync point, at most
+// EVENTS_PAGE_SIZE of them.
+func (c *DroveClient) FetchEvents(syncPoint *CurrSyncPoint) (*DroveEventList, error) {
+	var eventsApiResponse = DroveEventListApiResponse{}
+	host, err := c.getRequest(fmt.Sprintf("/apis/v1/cluster/events?lastSyncTime=%d&size=%d", syncPoint.LastSyncTime, EVENTS_PAGE_SIZE), c.sync.FetchEventsTimeout, &eventsApiResponse, nil)
+	if err != nil {
+		return nil, err
+	}
+	log.Debugf("events response with %d events", len(eventsApiResponse.EventList.Events))
+	syncPoint.advance(host, eventsApiResponse.EventList.LastSyncTime)
+	return &(eventsApiResponse.EventList), nil
+}
+
+func (c *DroveClient) PollEvents(callback func(event *DroveEventSummary), resync func()) {
+	c.pollLoop(func(syncData *CurrSyncPoint) (func(), error) {
+		eventSummary, err := c.FetchRecentEvents(syncData)
+		if err != nil {
+			return nil, err
+		}
+		return func() { callback(eventSummary) }, nil
+	}, resync)
+}
+
+// PollEventDetails polls the detailed event list. The first poll only positions
+// the sync point, older events were already accounted for by the initial fetch.
+func (c *DroveClient) PollEventDetails(callback func(events []*DroveEvent), resync func()) {
+	c.pollLoop(func(syncData *CurrSyncPoint) (func(), error) {
+		initial := syncData.LastSyncTime == 0
+		eventList, err := c.FetchEvents(syncData)
+		if err != nil {
+			return nil, err
+		}
+		if initial || len(eventList.Events) == 0 {
+			return func() {}, nil
+		}
+		return func() { callback(eventList.Events) }, nil
+	}, resync)
+}
+
+// pollLoop calls poll every EventPollInterval. The sync point is locked while
+// polling, the returned deliver func is called after releasing it. resync is
+// called whenever the sync point had to be reset, as events may have been missed.
+func (c *DroveClient) pollLoop(poll func(syncData *CurrSyncPoint) (func(), error), resync func()) {
 	go func() {
 
 		syncData := CurrSyncPoint{}
-		refreshInterval := 2
-
-		ticker := time.NewTicker(time.Duration(refreshInterval) * time.Second)
-		for range ticker.C {
-			func() {
-				log.Debugf("Syncing... at %d", time.Now().UnixMilli())
-				syncData.Lock()
-				defer syncData.Unlock()
-				eventSummary, err := c.FetchRecentEvents(&syncData)
-				if err != nil {
-					log.Errorf("unable to sync events from drove %s", err.Error())
-				} else {
-					callback(eventSummary)
-				}
-			}()
+
+		ticker := time.NewTicker(c.sync.EventPollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-c.done:
+				return
+			case <-ticker.C:
+			}
+			log.Debugf("Syncing... at %d", time.Now().UnixMilli())
+			syncData.Lock()
+			if leader := c.leader(); leader != nil && syncData.Leader != "" && syncData.Leader != leader.Endpoint {
+				log.Infof("Leader changed from %s to %s, resetting event sync point", syncData.Leader, leader.Endpoint)
+				syncData.reset(SYNC_RESET_LEADER_CHANGE)
+			}
+			deliver, err := poll(&syncData)
+			needsResync := syncData.resetPending
+			syncData.resetPending = false
+			syncData.Unlock()
+			if needsResync {
+				resync()
+			}
+			if err != nil {
+				log.Errorf("unable to sync events from drove %s", err.Error())
+				continue
+			}
+			deliver()
 		}
 	}()
 }
 
-func setHeaders(config DroveAuthConfig, req *http.Request) {
-	req.Header.Set("Accept", "application/json")
-	if config.User != "" {
-		req.SetBasicAuth(config.User, config.Pass)
-	}
-	if config.AccessToken != "" {
-		req.Header.Add("Authorization", config.AccessToken)
-	}
-}
-
 func leaderController(endpoint string) (*LeaderController, error) {
 	if endpoint == "" {
 		return nil, fmt.Errorf("Empty leader endpoint")
@@ -169,87 +392,245 @@ func leaderController(endpoint string) (*LeaderController, error) {
 }
 
 func (c *DroveClient) endpoint() (string, error) {
-	c.EndpointMutex.RLock()
-	defer c.EndpointMutex.RUnlock()
-	var err error = nil
-	if c.Leader == nil || c.Leader.Endpoint == "" {
+	leader := c.leader()
+	if leader == nil || leader.Endpoint == "" {
 		return "", errors.New("all endpoints are down")
 	}
-	return c.Leader.Endpoint, err
+	return leader.Endpoint, nil
 }
 
-func (c *DroveClient) refreshLeaderData() {
-	var endpoint string
-	for _, es := range c.Endpoint {
-		DroveControllerHealth.WithLabelValues(es.Endpoint).Set(boolToDouble(es.Healthy))
+// leader returns the currently elected leader, nil if none was found yet.
+func (c *DroveClient) leader() *LeaderController {
+	return c.state.Load().leader
+}
+
+// endpoints returns the health of every controller as of the last health check.
+// The returned slice is shared and must not be modified.
+func (c *DroveClient) endpoints() []EndpointStatus {
+	return c.state.Load().endpoints
+}
+
+// Healthy reports whether at least one controller passed its health checks.
+func (c *DroveClient) Healthy() bool {
+	for _, es := range c.endpoints() {
 		if es.Healthy {
-			endpoint = es.Endpoint
+			return true
+		}
+	}
+	return false
+}
+
+func (c *DroveClient) refreshLeaderData(prev *controllerState, endpoints []EndpointStatus) *controllerState {
+	next := &controllerState{endpoints: endpoints, leader: prev.leader}
+	claimants := make([]string, 0, len(endpoints))
+	hints := make(map[string]int)
+	for _, es := range endpoints {
+		DroveControllerHealth.WithLabelValues(es.Endpoint).Set(boolToDouble(es.Healthy))
+		if !es.Healthy {
+			continue
+		}
+		if es.ClaimsLeader {
+			claimants = append(claimants, es.Endpoint)
+		}
+		if es.LeaderHint != "" {
+			hints[es.LeaderHint]++
 		}
 	}
+	DroveLeaderClaimants.Set(float64(len(claimants)))
 
-	if c.Leader == nil || endpoint != c.Leader.Endpoint {
-		log.Infof("Looks like master shifted. Will resync app new [%s] old[%+v]", endpoint, c.Leader)
+	endpoint := c.electLeader(prev.leader, claimants, hints)
+	if endpoint == "" {
+		if prev.leader != nil {
+			log.Warningf("No controller identified as leader, keeping last known leader %s", prev.leader.Endpoint)
+		}
+		return next
+	}
+
+	if prev.leader == nil || endpoint != prev.leader.Endpoint {
+		log.Infof("Looks like master shifted. Will resync app new [%s] old[%+v]", endpoint, prev.leader)
 		newLeader, err := leaderController(endpoint)
 		if err != nil {
 			log.Errorf("Leader struct generation failed %+v", err)
-			return
+			return next
+		}
+		if prev.leader != nil {
+			newLeader.Term = prev.leader.Term + 1
+			DroveLeader.DeleteLabelValues(prev.leader.Endpoint)
+		} else {
+			newLeader.Term = 1
 		}
-		c.EndpointMutex.Lock()
-		defer c.EndpointMutex.Unlock()
-		c.Leader = newLeader
-		log.Infof("New leader being set leader %+v", c.Leader)
+		next.leader = newLeader
+		// Failures seen while it was not the leader must not delay the failover
+		if breaker, ok := c.breakers[endpoint]; ok {
+			breaker.reset()
+		}
+		DroveLeader.WithLabelValues(newLeader.Endpoint).Set(1)
+		DroveLeaderTerm.Set(float64(newLeader.Term))
+		log.Infof("New leader being set leader %+v", newLeader)
 	}
+	return next
 }
 
-func (c *DroveClient) endpointHealth() {
-	go func() {
-		ticker := time.NewTicker(2 * time.Second)
-		for {
-			select {
-			case <-ticker.C:
-				shouldReturn := c.updateHealth()
-				if shouldReturn {
-					return
-				}
+// electLeader picks the leader out of the controllers that claimed leadership on
+// their last probe. Redirect hints from followers break ties and identify the
+// leader when it could not be probed directly.
+func (c *DroveClient) electLeader(current *LeaderController, claimants []string, hints map[string]int) string {
+	if len(claimants) == 1 {
+		return claimants[0]
+	}
+	if len(claimants) == 0 {
+		best := ""
+		for _, controller := range c.controllers {
+			if hints[controller] > hints[best] {
+				best = controller
 			}
 		}
-	}()
+		return best
+	}
+
+	DroveLeaderConflicts.Inc()
+	log.Warningf("Split brain detected, multiple controllers claim leadership %v", claimants)
+	best := ""
+	for _, claimant := range claimants {
+		if hints[claimant] > hints[best] {
+			best = claimant
+		}
+	}
+	if best != "" {
+		return best
+	}
+	if current != nil {
+		for _, claimant := range claimants {
+			if claimant == current.Endpoint {
+				return claimant
+			}
+		}
+	}
+	return claimants[0]
 }
 
-func (c *DroveClient) updateHealth() bool {
-	log.Debugf("Updating health  %+v", c.Endpoint)
-	for i, es := range c.Endpoint {
-		ctx, cancel := context.WithTimeout(context.Background(), PING_TIMEOUT)
-		defer cancel()
-		req, err := http.NewRequestWithContext(ctx, "GET", es.Endpoint+"/apis/v1/ping", nil)
+// resolveLeaderHint maps the Location of a redirect issued by a follower back to
+// one of the configured controller endpoints. Redirects to unknown hosts are ignored.
+func (c *DroveClient) resolveLeaderHint(location string) string {
+	if location == "" {
+		return ""
+	}
+	target, err := url.Parse(location)
+	if err != nil || target.Host == "" {
+		return ""
+	}
+	for _, controller := range c.controllers {
+		configured, err := url.Parse(controller)
 		if err != nil {
-			log.Errorf("an error occurred creating endpoint health request %s %s", es.Endpoint, err.Error())
-			c.Endpoint[i].Healthy = false
-			c.Endpoint[i].Message = err.Error()
 			continue
 		}
-		setHeaders(*c.AuthConfig, req)
-		resp, err := c.client.Do(req)
-		if err != nil {
-			log.Errorf("endpoint is down %s %s", es.Endpoint, err)
-			c.Endpoint[i].Healthy = false
-			c.Endpoint[i].Message = err.Error()
-			continue
+		if strings.EqualFold(configured.Host, target.Host) {
+			return controller
 		}
-		resp.Body.Close()
+	}
+	return ""
+}
 
-		if resp.StatusCode != 200 {
-			if resp.StatusCode != 400 {
-				log.Errorf("Unknown responsecode from drove %d %+v", resp.StatusCode, resp)
+func (c *DroveClient) endpointHealth() {
+	go func() {
+		timer := time.NewTimer(jitter(c.sync.HealthCheckInterval, HEALTH_CHECK_JITTER))
+		defer timer.Stop()
+		for {
+			select {
+			case <-c.done:
+				return
+			case <-timer.C:
 			}
-			c.Endpoint[i].Healthy = false
-			c.Endpoint[i].Message = resp.Status
-			continue
+			shouldReturn := c.updateHealth()
+			if shouldReturn {
+				return
+			}
+			timer.Reset(jitter(c.sync.HealthCheckInterval, HEALTH_CHECK_JITTER))
 		}
-		c.Endpoint[i].Healthy = true
-		c.Endpoint[i].Message = "OK"
-		log.Debugf("Endpoint is healthy host %s", es.Endpoint)
+	}()
+}
+
+func (c *DroveClient) updateHealth() bool {
+	c.healthMutex.Lock()
+	defer c.healthMutex.Unlock()
+	prev := c.state.Load()
+	log.Debugf("Updating health  %+v", prev.endpoints)
+	probes := make([]EndpointStatus, len(prev.endpoints))
+	var wg sync.WaitGroup
+	for i, es := range prev.endpoints {
+		wg.Add(1)
+		go func(i int, endpoint string) {
+			defer wg.Done()
+			probes[i] = c.probe(endpoint)
+		}(i, es.Endpoint)
 	}
-	c.refreshLeaderData()
+	wg.Wait()
+
+	endpoints := make([]EndpointStatus, len(prev.endpoints))
+	for i := range prev.endpoints {
+		endpoints[i] = c.applyThresholds(prev.endpoints[i], probes[i])
+	}
+	c.state.Store(c.refreshLeaderData(prev, endpoints))
 	return false
 }
+
+// applyThresholds only flips the health of a controller after enough consecutive
+// probes agree, so a single slow ping doesn't trigger a leader failover.
+func (c *DroveClient) applyThresholds(prev EndpointStatus, probe EndpointStatus) EndpointStatus {
+	firstProbe := prev.failures == 0 && prev.successes == 0
+	if probe.Healthy {
+		probe.successes = prev.successes + 1
+		if !firstProbe && !prev.Healthy && probe.successes < c.healthyThreshold {
+			log.Debugf("Endpoint %s recovering %d/%d", probe.Endpoint, probe.successes, c.healthyThreshold)
+			prev.successes, prev.failures = probe.successes, 0
+			return prev
+		}
+		return probe
+	}
+
+	probe.failures = prev.failures + 1
+	if !firstProbe && prev.Healthy && probe.failures < c.unhealthyThreshold {
+		log.Debugf("Endpoint %s failing %d/%d", probe.Endpoint, probe.failures, c.unhealthyThreshold)
+		prev.successes, prev.failures = 0, probe.failures
+		return prev
+	}
+	return probe
+}
+
+// probe pings a single controller. The leader answers 200, followers either
+// answer 400 or redirect to the leader.
+func (c *DroveClient) probe(endpoint string) EndpointStatus {
+	start := time.Now()
+	defer func() {
+		DroveProbeLatency.WithLabelValues(endpoint).Observe(time.Since(start).Seconds())
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), c.sync.PingTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", endpoint+"/apis/v1/ping", nil)
+	if err != nil {
+		log.Errorf("an error occurred creating endpoint health request %s %s", endpoint, err.Error())
+		return EndpointStatus{Endpoint: endpoint, Healthy: false, Message: err.Error()}
+	}
+	resp, err := c.send(req)
+	if err != nil {
+		log.Errorf("endpoint is down %s %s", endpoint, err)
+		return EndpointStatus{Endpoint: endpoint, Healthy: false, Message: err.Error()}
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		log.Debugf("Endpoint is healthy and claims leadership host %s", endpoint)
+		return EndpointStatus{Endpoint: endpoint, Healthy: true, Message: "OK", ClaimsLeader: true}
+	case resp.StatusCode >= 300 && resp.StatusCode < 400:
+		hint := c.resolveLeaderHint(resp.Header.Get("Location"))
+		log.Debugf("Endpoint %s redirected to leader %q", endpoint, hint)
+		return EndpointStatus{Endpoint: endpoint, Healthy: true, Message: resp.Status, LeaderHint: hint}
+	case resp.StatusCode == http.StatusBadRequest:
+		log.Debugf("Endpoint is healthy but not leader host %s", endpoint)
+		return EndpointStatus{Endpoint: endpoint, Healthy: true, Message: resp.Status}
+	default:
+		log.Errorf("Unknown responsecode from drove %d %+v", resp.StatusCode, resp)
+		return EndpointStatus{Endpoint: endpoint, Healthy: false, Message: resp.Status}
+	}
+}
@@ -1,93 +1,361 @@
 package drovedns
 
 import (
+	"errors"
+	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+const EVENT_BUFFER_SIZE int = 1024
+
 type DroveEndpoints struct {
-	appsMutex   *sync.RWMutex
-	AppsDB      *DroveAppsResponse
-	DroveClient IDroveClient
-	AppsByVhost map[string]DroveApp
+	// index is replaced on every snapshot and read without locks by queries
+	index       atomic.Pointer[appIndex]
+	Backend     Backend
+	guard       *snapshotGuard
+	subsMutex   sync.Mutex
+	subscribers []func(diff SnapshotDiff)
+	// lastSnapshot is the unix nanos of the last successful sync
+	lastSnapshot atomic.Int64
+	// synced is closed once the first snapshot was stored
+	synced     chan struct{}
+	syncedOnce sync.Once
+	// done is closed by Stop to end the sync loop
+	done     chan struct{}
+	stopOnce sync.Once
 }
 
-func (dr *DroveEndpoints) setApps(appDB *DroveAppsResponse) {
+// indexApps returns the apps by vhost. A streamed response already carries its
+// index, which is shared as snapshots are never modified.
+func indexApps(appDB *DroveAppsResponse) map[string]DroveApp {
+	if appDB != nil && appDB.byVhost != nil {
+		return appDB.byVhost
+	}
 	var appsByVhost map[string]DroveApp = make(map[string]DroveApp)
 	if appDB != nil {
 		for _, app := range appDB.Apps {
 			appsByVhost[app.Vhost+"."] = app
 		}
 	}
-	dr.appsMutex.Lock()
-	dr.AppsDB = appDB
-	dr.AppsByVhost = appsByVhost
-	dr.appsMutex.Unlock()
+	return appsByVhost
 }
 
-func (dr *DroveEndpoints) getApps() *DroveAppsResponse {
-	dr.appsMutex.RLock()
-	defer dr.appsMutex.RUnlock()
-	if dr.AppsDB == nil {
-		return nil
+// applySnapshot installs a freshly fetched snapshot unless the guard holds it
+// back, and returns what changed.
+func (dr *DroveEndpoints) applySnapshot(appDB *DroveAppsResponse) (SnapshotDiff, bool) {
+	appsByVhost := indexApps(appDB)
+	if !dr.guard.allow(dr.appsByVhost(), appsByVhost) {
+		return SnapshotDiff{}, false
 	}
-	return dr.AppsDB
+	return dr.storeApps(appDB, appsByVhost), true
 }
 
-func (dr *DroveEndpoints) searchApps(questionName string) *DroveApp {
-	dr.appsMutex.RLock()
-	defer dr.appsMutex.RUnlock()
-	if dr.AppsByVhost == nil {
+func (dr *DroveEndpoints) setApps(appDB *DroveAppsResponse) {
+	dr.storeApps(appDB, indexApps(appDB))
+}
+
+func (dr *DroveEndpoints) storeApps(appDB *DroveAppsResponse, appsByVhost map[string]DroveApp) SnapshotDiff {
+	dr.markSynced()
+	// Snapshots are only stored by the sync goroutine, so current stays installed
+	// until replaced here
+	current := dr.index.Load()
+	var prev map[string]DroveApp
+	if current != nil {
+		prev = current.byVhost
+	}
+	dr.index.Store(newAppIndex(appDB, appsByVhost, current))
+	if appDB != nil && dr.synced != nil {
+		dr.syncedOnce.Do(func() { close(dr.synced) })
+	}
+
+	diff := diffApps(prev, appsByVhost)
+	if diff.Empty() {
+		return diff
+	}
+	log.Infof("Apps changed: %s", diff)
+	for _, v := range diff.Vhosts {
+		log.Debugf("Vhost %s hosts added %v removed %v", v.Vhost, v.HostsAdded, v.HostsRemoved)
+	}
+	DroveSnapshotChanges.WithLabelValues("app_added").Add(float64(len(diff.AppsAdded)))
+	DroveSnapshotChanges.WithLabelValues("app_removed").Add(float64(len(diff.AppsRemoved)))
+	DroveSnapshotChanges.WithLabelValues("host_added").Add(float64(diff.HostsAdded()))
+	DroveSnapshotChanges.WithLabelValues("host_removed").Add(float64(diff.HostsRemoved()))
+	dr.notify(diff)
+	return diff
+}
+
+// Subscribe registers fn to be called with the diff every time a snapshot that
+// changes apps or hosts is installed. fn runs on the sync goroutine and should
+// return quickly.
+func (dr *DroveEndpoints) Subscribe(fn func(diff SnapshotDiff)) {
+	dr.subsMutex.Lock()
+	defer dr.subsMutex.Unlock()
+	dr.subscribers = append(dr.subscribers, fn)
+}
+
+func (dr *DroveEndpoints) notify(diff SnapshotDiff) {
+	dr.subsMutex.Lock()
+	subscribers := dr.subscribers
+	dr.subsMutex.Unlock()
+	for _, fn := range subscribers {
+		fn(diff)
+	}
+}
+
+// markSynced records that the apps are in line with the controllers. A snapshot
+// held back by the guard counts as well, the controllers were reachable.
+func (dr *DroveEndpoints) markSynced() {
+	now := time.Now()
+	dr.lastSnapshot.Store(now.UnixNano())
+	DroveLastSnapshot.Set(float64(now.Unix()))
+}
+
+func (dr *DroveEndpoints) markAttempt() {
+	DroveLastSyncAttempt.Set(float64(time.Now().Unix()))
+}
+
+func (dr *DroveEndpoints) snapshotAge() time.Duration {
+	return time.Since(time.Unix(0, dr.lastSnapshot.Load()))
+}
+
+// Stop ends syncing apps and watching the backend. The last snapshot is still
+// served.
+func (dr *DroveEndpoints) Stop() {
+	dr.stopOnce.Do(func() {
+		if dr.done != nil {
+			close(dr.done)
+		}
+		if dr.Backend != nil {
+			dr.Backend.Stop()
+		}
+	})
+}
+
+// waitForSync blocks until the first snapshot was stored or timeout expires.
+func (dr *DroveEndpoints) waitForSync(timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-dr.synced:
 		return nil
+	case <-timer.C:
+		return fmt.Errorf("no apps synced from drove within %s", timeout)
 	}
-	if app, ok := dr.AppsByVhost[questionName]; ok {
+}
+
+// currentIndex returns the index of the installed snapshot, nil before the first one.
+func (dr *DroveEndpoints) currentIndex() *appIndex {
+	return dr.index.Load()
+}
+
+func (dr *DroveEndpoints) getApps() *DroveAppsResponse {
+	if index := dr.index.Load(); index != nil {
+		return index.appDB
+	}
+	return nil
+}
+
+func (dr *DroveEndpoints) appsByVhost() map[string]DroveApp {
+	if index := dr.index.Load(); index != nil {
+		return index.byVhost
+	}
+	return nil
+}
+
+func (dr *DroveEndpoints) searchApps(questionName string) *DroveApp {
+	if app, ok := dr.appsByVhost()[questionName]; ok {
 		return &app
 	}
 	return nil
 }
 
-func newDroveEndpoints(client IDroveClient) *DroveEndpoints {
-	endpoints := DroveEndpoints{DroveClient: client, appsMutex: &sync.RWMutex{}}
-	ticker := time.NewTicker(10 * time.Second)
-	done := make(chan bool)
-	reload := make(chan bool)
-	endpoints.DroveClient.PollEvents(func(eventSummary *DroveEventSummary) {
-		if len(eventSummary.EventsCount) > 0 {
-			if _, ok := eventSummary.EventsCount["APP_STATE_CHANGE"]; ok {
-				log.Debugf("App State Change %+v", eventSummary.EventsCount["APP_STATE_CHANGE"])
-				reload <- true
-				return
+// applyInstanceChanges patches the hosts of the affected apps in a copy of the
+// current snapshot. It returns false if a change refers to an app unknown to the
+// snapshot, in which case only a full fetch can bring it in.
+func (dr *DroveEndpoints) applyInstanceChanges(changes []InstanceChange) bool {
+	index := dr.index.Load()
+	if index == nil || index.byVhost == nil {
+		return false
+	}
+	prev, appDB := index.byVhost, index.appDB
+
+	vhostsByApp := make(map[string][]string)
+	for vhost, app := range prev {
+		vhostsByApp[app.ID] = append(vhostsByApp[app.ID], vhost)
+	}
+	next := make(map[string]DroveApp, len(prev))
+	for vhost, app := range prev {
+		next[vhost] = app
+	}
+	complete := true
+	for _, change := range changes {
+		vhosts, ok := vhostsByApp[change.AppID]
+		if !ok {
+			if change.Healthy() {
+				log.Debugf("Instance %s of unknown app %s became healthy", change.InstanceID, change.AppID)
+				complete = false
 			}
-			if _, ok := eventSummary.EventsCount["INSTANCE_STATE_CHANGE"]; ok {
-				log.Debugf("Instance State Change %+v", eventSummary.EventsCount["INSTANCE_STATE_CHANGE"])
-				reload <- true
-				return
+			continue
+		}
+		for _, vhost := range vhosts {
+			app := next[vhost]
+			app.Hosts = patchHosts(app.Hosts, change)
+			next[vhost] = app
+		}
+	}
+	dr.storeApps(appDB, next)
+	return complete
+}
+
+// patchHosts returns hosts with the instance added or removed. The input slice is
+// shared with the previous snapshot and never modified.
+func patchHosts(hosts []DroveServiceHost, change InstanceChange) []DroveServiceHost {
+	key := hostKey(change.Host)
+	for i, h := range hosts {
+		if hostKey(h) != key {
+			continue
+		}
+		if change.Healthy() {
+			return hosts
+		}
+		patched := make([]DroveServiceHost, 0, len(hosts)-1)
+		patched = append(patched, hosts[:i]...)
+		return append(patched, hosts[i+1:]...)
+	}
+	if !change.Healthy() {
+		return hosts
+	}
+	patched := make([]DroveServiceHost, 0, len(hosts)+1)
+	patched = append(patched, hosts...)
+	return append(patched, change.Host)
+}
+
+// handleEvents patches the snapshot once for all instance events carrying enough
+// detail and falls back to a full reload for everything else listed in reloadEvents.
+func (dr *DroveEndpoints) handleEvents(events []*DroveEvent, reloadEvents []string, reload *reloadTrigger) {
+	changes := make([]InstanceChange, 0, len(events))
+	changeType := ""
+	needsReload := false
+	for _, event := range events {
+		if change, ok := event.instanceChange(); ok {
+			log.Debugf("Instance %s of app %s is %s", change.InstanceID, change.AppID, change.State)
+			changes = append(changes, change)
+			changeType = event.Type
+			continue
+		}
+		needsReload = needsReload || matchesEvent(event.Type, reloadEvents)
+	}
+	if len(changes) > 0 && !dr.applyInstanceChanges(changes) {
+		needsReload = needsReload || matchesEvent(changeType, reloadEvents)
+	}
+	if needsReload {
+		reload.Trigger()
+	}
+}
+
+func matchesEvent(eventType string, reloadEvents []string) bool {
+	for _, reloadEvent := range reloadEvents {
+		if reloadEvent == "*" || reloadEvent == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// reloadEvent returns the first event type of the summary that should trigger a reload.
+func reloadEvent(eventSummary *DroveEventSummary, reloadEvents []string) (string, bool) {
+	for _, eventType := range reloadEvents {
+		if eventType == "*" {
+			for name := range eventSummary.EventsCount {
+				return name, true
 			}
+			continue
 		}
-	})
+		if _, ok := eventSummary.EventsCount[eventType]; ok {
+			return eventType, true
+		}
+	}
+	return "", false
+}
+
+func newDroveEndpoints(client IDroveClient, config DroveConfig) *DroveEndpoints {
+	return newBackendEndpoints(newDroveBackend(client, config.Sync.withDefaults()), config)
+}
+
+func newBackendEndpoints(backend Backend, config DroveConfig) *DroveEndpoints {
+	endpoints := DroveEndpoints{Backend: backend, guard: &snapshotGuard{config: config.SnapshotGuard}, synced: make(chan struct{}), done: make(chan struct{})}
+	syncConfig := config.Sync.withDefaults()
+	endpoints.markAttempt()
+	ticker := time.NewTicker(syncConfig.RefreshInterval)
+	reload := newReloadTrigger(syncConfig.ReloadDebounce, syncConfig.ReloadMaxDelay)
+	events := make(chan []*DroveEvent, EVENT_BUFFER_SIZE)
+	onEvents := func(batch []*DroveEvent) {
+		for _, event := range batch {
+			DroveEventsReceived.WithLabelValues(event.Type).Inc()
+		}
+		select {
+		case events <- batch:
+		default:
+			log.Warningf("Event buffer full, dropping %d events and reloading all apps", len(batch))
+			reload.Trigger()
+		}
+	}
+	backend.Watch(BackendListener{Changed: reload.Trigger, Events: onEvents})
 	go func() {
-		var syncApp = func() {
+		// checkDrift is set for the periodic resync. With incremental updates any
+		// change it finds was missed by the event feed.
+		var syncApp = func(checkDrift bool) {
+			defer endpoints.markAttempt()
 			DroveQueryTotal.Inc()
-			apps, err := endpoints.DroveClient.FetchApps()
+			apps, err := endpoints.Backend.FetchApps()
+			if errors.Is(err, ErrNotModified) {
+				endpoints.markSynced()
+				// Offer the unchanged snapshot again if the installed one may differ from it
+				if !checkDrift && !endpoints.guard.holding() {
+					log.Debug("Apps not modified since the last fetch")
+					return
+				}
+				err = nil
+			}
 			if err != nil {
 				DroveQueryFailure.Inc()
-				log.Errorf("Error refreshing nodes data")
+				log.Errorf("Error refreshing nodes data, keeping previous snapshot [%s]: %v", apiErrorKind(err), err)
 				return
 			}
+			endpoints.markSynced()
 
-			endpoints.setApps(apps)
+			diff, applied := endpoints.applySnapshot(apps)
+			if checkDrift && applied && !diff.Empty() {
+				log.Warningf("Full resync found drift from incremental updates: %s", diff)
+				DroveSnapshotDrift.WithLabelValues("app_added").Add(float64(len(diff.AppsAdded)))
+				DroveSnapshotDrift.WithLabelValues("app_removed").Add(float64(len(diff.AppsRemoved)))
+				DroveSnapshotDrift.WithLabelValues("host_added").Add(float64(diff.HostsAdded()))
+				DroveSnapshotDrift.WithLabelValues("host_removed").Add(float64(diff.HostsRemoved()))
+			}
 		}
-		syncApp()
+		syncApp(false)
 		for {
 			select {
-			case <-done:
+			case <-endpoints.done:
+				ticker.Stop()
+				reload.Stop()
 				return
-			case <-reload:
+			case batch := <-events:
+				// Events queued meanwhile are applied along, so a burst patches the
+				// snapshot once instead of once per event
+				batch = batch[:len(batch):len(batch)]
+				for queued := len(events); queued > 0; queued-- {
+					batch = append(batch, <-events...)
+				}
+				endpoints.handleEvents(batch, syncConfig.ReloadEvents, reload)
+			case <-reload.C:
 				log.Debug("Refreshing Apps due to event change from drove")
-				syncApp()
+				syncApp(false)
 			case _ = <-ticker.C:
 				log.Debug("Refreshing Apps data from drove")
-				syncApp()
+				syncApp(syncConfig.incremental())
 			}
 		}
 	}()
@@ -4,8 +4,14 @@ import (
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestRaceCondidtion(t *testing.T) {
@@ -26,7 +32,7 @@ func TestRaceCondidtion(t *testing.T) {
 		rw.Header().Set("Content-Type", "application/json")
 		rw.WriteHeader(http.StatusOK)
 
-		fmt.Fprint(rw, `{"status": "ok", "message": "ok", "data":[{"appId": "PS", "vhost": "ps.blah", "tags": {}, "hosts":[{"host": "host", "port": 1234, "portType": "http"}]}]}`)
+		fmt.Fprint(rw, `{"status": "SUCCESS", "message": "ok", "data":[{"appId": "PS", "vhost": "ps.blah", "tags": {}, "hosts":[{"host": "host", "port": 1234, "portType": "http"}]}]}`)
 	})
 
 	mux.HandleFunc("/apis/v1/cluster/events/summary", func(rw http.ResponseWriter, req *http.Request) {
@@ -44,7 +50,7 @@ func TestRaceCondidtion(t *testing.T) {
 	// Use Client & URL from our local test server
 	client := NewDroveClient(DroveConfig{Endpoint: server.URL, AuthConfig: DroveAuthConfig{AccessToken: ""}})
 	client.Init()
-	underTest := newDroveEndpoints(&client)
+	underTest := newDroveEndpoints(client, NewDroveConfig())
 	go func() {
 		for i := 0; i < 100; i++ {
 			go func() {
@@ -69,3 +75,279 @@ func TestRaceCondidtion(t *testing.T) {
 	}()
 	time.Sleep(1)
 }
+
+func appsSnapshot(hostsByVhost map[string]int) *DroveAppsResponse {
+	apps := &DroveAppsResponse{Status: "SUCCESS"}
+	for vhost, count := range hostsByVhost {
+		app := DroveApp{ID: vhost, Vhost: vhost}
+		for i := 0; i < count; i++ {
+			app.Hosts = append(app.Hosts, DroveServiceHost{Host: fmt.Sprintf("host%d", i), Port: 8080, PortType: "http"})
+		}
+		apps.Apps = append(apps.Apps, app)
+	}
+	return apps
+}
+
+func TestSnapshotGuard(t *testing.T) {
+	config := NewDroveConfig()
+	config.SnapshotGuard = SnapshotGuardConfig{MaxRemovalPercent: 30, OverrideAfter: 2}
+	underTest := &DroveEndpoints{guard: &snapshotGuard{config: config.SnapshotGuard}}
+	apply := func(hostsByVhost map[string]int) bool {
+		_, applied := underTest.applySnapshot(appsSnapshot(hostsByVhost))
+		return applied
+	}
+
+	assert.True(t, apply(map[string]int{"a": 4, "b": 4, "c": 2}), "First snapshot is always applied")
+	assert.True(t, apply(map[string]int{"a": 4, "b": 3, "c": 2, "d": 1}), "Removing one host is within limits")
+
+	shrunk := map[string]int{"a": 4}
+	assert.False(t, apply(shrunk), "Removing most apps is held back")
+	assert.NotNil(t, underTest.searchApps("b."), "Previous snapshot should still be served")
+
+	assert.True(t, apply(shrunk), "Consistent fetches override the guard")
+	assert.Nil(t, underTest.searchApps("b."))
+}
+
+func TestSnapshotGuardHostRemoval(t *testing.T) {
+	guard := &snapshotGuard{config: SnapshotGuardConfig{MaxRemovalPercent: 50}}
+	prev := indexApps(appsSnapshot(map[string]int{"a": 10}))
+	assert.False(t, guard.allow(prev, indexApps(appsSnapshot(map[string]int{"a": 2}))), "Removing 80% of hosts is held back")
+	assert.False(t, guard.allow(prev, indexApps(appsSnapshot(map[string]int{"a": 2}))), "Guard without override never gives in")
+	assert.True(t, guard.allow(prev, indexApps(appsSnapshot(map[string]int{"a": 6}))))
+
+	disabled := &snapshotGuard{}
+	assert.True(t, disabled.allow(prev, map[string]DroveApp{}))
+}
+
+func TestDiffApps(t *testing.T) {
+	prev := indexApps(appsSnapshot(map[string]int{"a": 2, "b": 1, "c": 1}))
+	next := indexApps(appsSnapshot(map[string]int{"a": 3, "b": 1, "d": 1}))
+	diff := diffApps(prev, next)
+	assert.Equal(t, []string{"d."}, diff.AppsAdded)
+	assert.Equal(t, []string{"c."}, diff.AppsRemoved)
+	assert.Equal(t, []string{"a.", "c.", "d."}, diff.ChangedVhosts())
+	assert.Equal(t, 2, diff.HostsAdded())
+	assert.Equal(t, 1, diff.HostsRemoved())
+	assert.Equal(t, "host2", diff.Vhosts[0].HostsAdded[0].Host)
+
+	assert.True(t, diffApps(prev, prev).Empty())
+}
+
+func TestSnapshotSubscribers(t *testing.T) {
+	underTest := &DroveEndpoints{guard: &snapshotGuard{}}
+	diffs := make([]SnapshotDiff, 0)
+	underTest.Subscribe(func(diff SnapshotDiff) {
+		diffs = append(diffs, diff)
+	})
+
+	underTest.setApps(appsSnapshot(map[string]int{"a": 1}))
+	underTest.setApps(appsSnapshot(map[string]int{"a": 1}))
+	underTest.setApps(appsSnapshot(map[string]int{"a": 2}))
+	assert.Equal(t, 2, len(diffs), "Unchanged snapshots should not notify")
+	assert.Equal(t, []string{"a."}, diffs[0].AppsAdded)
+	assert.Equal(t, 1, diffs[1].HostsAdded())
+}
+
+func TestReloadTriggerCoalesces(t *testing.T) {
+	trigger := newReloadTrigger(20*time.Millisecond, 100*time.Millisecond)
+	for i := 0; i < 50; i++ {
+		trigger.Trigger()
+	}
+	select {
+	case <-trigger.C:
+	case <-time.After(time.Second):
+		t.Fatal("Reload should fire")
+	}
+	select {
+	case <-trigger.C:
+		t.Fatal("Burst should result in a single reload")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestReloadTriggerMaxDelay(t *testing.T) {
+	trigger := newReloadTrigger(40*time.Millisecond, 100*time.Millisecond)
+	start := time.Now()
+	stop := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(10 * time.Millisecond):
+				trigger.Trigger()
+			}
+		}
+	}()
+	<-trigger.C
+	close(stop)
+	assert.Less(t, time.Since(start), 300*time.Millisecond, "Continuous events should not postpone the reload beyond max delay")
+}
+
+func TestReloadEvent(t *testing.T) {
+	summary := &DroveEventSummary{EventsCount: map[string]interface{}{"EXECUTOR_ADDED": 1}}
+	_, ok := reloadEvent(summary, DEFAULT_RELOAD_EVENTS)
+	assert.False(t, ok)
+
+	eventType, ok := reloadEvent(summary, []string{"APP_STATE_CHANGE", "EXECUTOR_ADDED"})
+	assert.True(t, ok)
+	assert.Equal(t, "EXECUTOR_ADDED", eventType)
+
+	_, ok = reloadEvent(summary, []string{"*"})
+	assert.True(t, ok)
+	_, ok = reloadEvent(&DroveEventSummary{}, []string{"*"})
+	assert.False(t, ok)
+}
+
+func TestApplyInstanceChanges(t *testing.T) {
+	underTest := &DroveEndpoints{guard: &snapshotGuard{}}
+	assert.False(t, underTest.applyInstanceChanges([]InstanceChange{{AppID: "a.", State: "HEALTHY"}}), "Nothing to patch before the first snapshot")
+
+	underTest.setApps(appsSnapshot(map[string]int{"a": 2, "b": 1}))
+	untouched := underTest.searchApps("b.").Hosts
+
+	assert.True(t, underTest.applyInstanceChanges([]InstanceChange{
+		{AppID: "a", State: "HEALTHY", Host: DroveServiceHost{Host: "host9", Port: 8080}},
+		{AppID: "a", State: "STOPPED", Host: DroveServiceHost{Host: "host0", Port: 8080}},
+		{AppID: "b", State: "HEALTHY", Host: DroveServiceHost{Host: "host0", Port: 8080}},
+	}))
+	hosts := underTest.searchApps("a.").Hosts
+	assert.Equal(t, []DroveServiceHost{{Host: "host1", Port: 8080, PortType: "http"}, {Host: "host9", Port: 8080}}, hosts)
+	assert.Equal(t, untouched, underTest.searchApps("b.").Hosts, "Healthy instance already known is a no-op")
+
+	assert.False(t, underTest.applyInstanceChanges([]InstanceChange{{AppID: "c", State: "HEALTHY", Host: DroveServiceHost{Host: "host0", Port: 8080}}}), "New app needs a full fetch")
+	assert.True(t, underTest.applyInstanceChanges([]InstanceChange{{AppID: "c", State: "STOPPED", Host: DroveServiceHost{Host: "host0", Port: 8080}}}))
+}
+
+func TestHandleEventsBatch(t *testing.T) {
+	underTest := &DroveEndpoints{guard: &snapshotGuard{}}
+	underTest.setApps(appsSnapshot(map[string]int{"a": 2, "b": 1}))
+	diffs := 0
+	underTest.Subscribe(func(diff SnapshotDiff) { diffs++ })
+	reload := newReloadTrigger(0, 0)
+	instanceEvent := func(appID string, state string, host string) *DroveEvent {
+		return &DroveEvent{
+			Type:     "INSTANCE_STATE_CHANGE",
+			Metadata: map[string]interface{}{"APP_ID": appID, "CURRENT_STATE": state, "EXECUTOR_HOST": host, "PORT": float64(8080)},
+		}
+	}
+
+	underTest.handleEvents([]*DroveEvent{
+		instanceEvent("a", "HEALTHY", "host9"),
+		instanceEvent("a", "STOPPED", "host0"),
+		instanceEvent("b", "HEALTHY", "host9"),
+	}, DEFAULT_RELOAD_EVENTS, reload)
+	assert.Equal(t, 1, diffs, "A batch should patch the snapshot once")
+	assert.Equal(t, 2, len(underTest.searchApps("a.").Hosts))
+	assert.Equal(t, 2, len(underTest.searchApps("b.").Hosts))
+	select {
+	case <-reload.C:
+		t.Fatal("Known apps should not trigger a reload")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	underTest.handleEvents([]*DroveEvent{instanceEvent("c", "HEALTHY", "host0"), {Type: "EXECUTOR_ADDED"}}, DEFAULT_RELOAD_EVENTS, reload)
+	select {
+	case <-reload.C:
+	case <-time.After(time.Second):
+		t.Fatal("Unknown app should trigger a reload")
+	}
+}
+
+type streamingMockClient struct {
+	MockDroveClient
+	polled         atomic.Bool
+	detailCallback atomic.Pointer[func(events []*DroveEvent)]
+}
+
+func (c *streamingMockClient) PollEvents(callback func(event *DroveEventSummary), resync func()) {
+	c.polled.Store(true)
+}
+
+func (c *streamingMockClient) PollEventDetails(callback func(events []*DroveEvent), resync func()) {
+	c.detailCallback.Store(&callback)
+}
+
+func TestWatchEventsFallsBackToPolling(t *testing.T) {
+	client := &streamingMockClient{}
+	config := NewDroveConfig()
+	config.Sync.EventTransport = EVENT_TRANSPORT_SSE
+	newDroveEndpoints(client, config)
+	assert.Eventually(t, client.polled.Load, time.Second, 10*time.Millisecond, "Polling should take over when streaming is unsupported")
+}
+
+func TestPolledEventsPatchSnapshot(t *testing.T) {
+	client := &streamingMockClient{}
+	config := NewDroveConfig()
+	config.Sync.EventTransport = EVENT_TRANSPORT_EVENTS
+	underTest := newDroveEndpoints(client, config)
+	assert.Eventually(t, func() bool { return underTest.getApps() != nil && client.detailCallback.Load() != nil }, time.Second, 10*time.Millisecond)
+
+	(*client.detailCallback.Load())([]*DroveEvent{{
+		Type:     "INSTANCE_STATE_CHANGE",
+		Metadata: map[string]interface{}{"APP_ID": "PS", "CURRENT_STATE": "HEALTHY", "EXECUTOR_HOST": "host2", "PORT": float64(4321)},
+	}})
+	assert.Eventually(t, func() bool { return len(underTest.searchApps("example.com.").Hosts) == 2 }, time.Second, 10*time.Millisecond, "Healthy instance should be added without a fetch")
+}
+
+func TestFileBackend(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "apps.yaml")
+	assert.Nil(t, os.WriteFile(path, []byte(`
+data:
+- appId: PS
+  vhost: ps.drove
+  hosts:
+  - host: host1
+    port: 1234
+    portType: http
+`), 0600))
+	config := NewDroveConfig()
+	config.Sync.EventPollInterval = 10 * time.Millisecond
+	config.Sync.ReloadDebounce = 0
+	backend := newFileBackend(path, config.Sync.EventPollInterval)
+	underTest := newBackendEndpoints(backend, config)
+	assert.Eventually(t, func() bool { return underTest.searchApps("ps.drove.") != nil }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, "host1", underTest.searchApps("ps.drove.").Hosts[0].Host)
+	assert.True(t, backend.Healthy())
+
+	// JSON in the schema of the endpoints api is picked up on change
+	assert.Nil(t, os.WriteFile(path, []byte(`{"status": "SUCCESS", "data": [{"appId": "PS", "vhost": "ps.drove", "hosts": [{"host": "host2", "port": 1234}]}]}`), 0600))
+	assert.Nil(t, os.Chtimes(path, time.Now(), time.Now().Add(time.Minute)))
+	assert.Eventually(t, func() bool { return underTest.searchApps("ps.drove.").Hosts[0].Host == "host2" }, time.Second, 10*time.Millisecond)
+
+	// A broken file keeps the previous snapshot
+	assert.Nil(t, os.WriteFile(path, []byte(`data: [`), 0600))
+	_, err := backend.FetchApps()
+	assert.Error(t, err)
+	assert.Equal(t, "host2", underTest.searchApps("ps.drove.").Hosts[0].Host)
+}
+
+func TestAppIndex(t *testing.T) {
+	underTest := &DroveEndpoints{guard: &snapshotGuard{}}
+	assert.False(t, underTest.currentIndex().ready())
+	underTest.setApps(appsSnapshot(map[string]int{"a": 2, "b": 1}))
+	index := underTest.currentIndex()
+	assert.True(t, index.ready())
+	srv := index.lookup("a.", dns.ClassINET)
+	assert.Equal(t, 2, len(srv))
+	assert.Equal(t, "a.", srv[0].Header().Name)
+	assert.NotSame(t, index.records["a."][0], srv[0], "Records should be copied for every reply")
+	srv[0].Header().Ttl = 5
+	assert.Equal(t, SRV_TTL, index.lookup("a.", dns.ClassINET)[0].Header().Ttl)
+	assert.Nil(t, index.lookup("c.", dns.ClassINET))
+	chaos := index.lookup("a.", dns.ClassCHAOS)
+	assert.Equal(t, uint16(dns.ClassCHAOS), chaos[0].Header().Class)
+	assert.Equal(t, uint16(dns.ClassINET), index.lookup("a.", dns.ClassINET)[0].Header().Class)
+
+	underTest.applyInstanceChanges([]InstanceChange{{AppID: "a", State: "HEALTHY", Host: DroveServiceHost{Host: "host9", Port: 8080}}})
+	next := underTest.currentIndex()
+	assert.Equal(t, 3, len(next.lookup("a.", dns.ClassINET)))
+	assert.Same(t, index.records["b."][0], next.records["b."][0], "Records of unchanged vhosts should be reused")
+	assert.Equal(t, 2, len(index.lookup("a.", dns.ClassINET)), "Previous index should stay unchanged")
+	assert.Equal(t, index.vhostGeneration("b."), next.vhostGeneration("b."))
+	assert.Equal(t, next.generation, next.vhostGeneration("a."))
+
+	underTest.setApps(appsSnapshot(map[string]int{"a": 2, "b": 1}))
+	assert.Equal(t, index.vhostGeneration("b."), underTest.currentIndex().vhostGeneration("b."), "Equal hosts keep their generation")
+	assert.Equal(t, uint64(0), underTest.currentIndex().vhostGeneration("c."))
+}
@@ -0,0 +1,121 @@
+package drovedns
+
+import (
+	"errors"
+	"fmt"
+)
+
+type ApiErrorKind string
+
+const (
+	ApiErrorTransport        ApiErrorKind = "transport"
+	ApiErrorAuth             ApiErrorKind = "auth"
+	ApiErrorNotLeader        ApiErrorKind = "not_leader"
+	ApiErrorServer           ApiErrorKind = "server"
+	ApiErrorUnexpectedStatus ApiErrorKind = "unexpected_status"
+	ApiErrorDecode           ApiErrorKind = "decode"
+	ApiErrorApiStatus        ApiErrorKind = "api_status"
+)
+
+// Sentinel errors to match a DroveApiError with errors.Is
+var (
+	ErrTransport        = errors.New("drove controller unreachable")
+	ErrAuthFailure      = errors.New("drove authentication failed")
+	ErrNotLeader        = errors.New("drove controller is not the leader")
+	ErrServerError      = errors.New("drove controller error")
+	ErrUnexpectedStatus = errors.New("unexpected status code from drove")
+	ErrDecode           = errors.New("unable to decode drove response")
+	ErrApiStatus        = errors.New("drove api call failed")
+
+	ErrStreamUnsupported = errors.New("drove controller does not support event streaming")
+	ErrNotModified       = errors.New("drove response not modified")
+)
+
+var apiErrorSentinels = map[ApiErrorKind]error{
+	ApiErrorTransport:        ErrTransport,
+	ApiErrorAuth:             ErrAuthFailure,
+	ApiErrorNotLeader:        ErrNotLeader,
+	ApiErrorServer:           ErrServerError,
+	ApiErrorUnexpectedStatus: ErrUnexpectedStatus,
+	ApiErrorDecode:           ErrDecode,
+	ApiErrorApiStatus:        ErrApiStatus,
+}
+
+// DroveApiError describes a failed call to a drove controller.
+type DroveApiError struct {
+	Kind       ApiErrorKind
+	Host       string
+	Path       string
+	StatusCode int
+	Message    string
+	Err        error
+}
+
+func (e *DroveApiError) Error() string {
+	msg := fmt.Sprintf("%s: %s%s", apiErrorSentinels[e.Kind], e.Host, e.Path)
+	if e.StatusCode != 0 {
+		msg += fmt.Sprintf(" status %d", e.StatusCode)
+	}
+	if e.Message != "" {
+		msg += " message: " + e.Message
+	}
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+func (e *DroveApiError) Unwrap() error { return e.Err }
+
+func (e *DroveApiError) Is(target error) bool {
+	return apiErrorSentinels[e.Kind] == target
+}
+
+// Retryable reports whether another attempt, possibly against another
+// controller, could succeed.
+func (e *DroveApiError) Retryable() bool {
+	switch e.Kind {
+	case ApiErrorAuth, ApiErrorUnexpectedStatus:
+		return false
+	}
+	return true
+}
+
+// apiErrorKind returns the kind of a DroveApiError, "other" for any other error.
+func apiErrorKind(err error) string {
+	var apiErr *DroveApiError
+	if errors.As(err, &apiErr) {
+		return string(apiErr.Kind)
+	}
+	return "other"
+}
+
+func isRetryable(err error) bool {
+	var apiErr *DroveApiError
+	if errors.As(err, &apiErr) {
+		return apiErr.Retryable()
+	}
+	return true
+}
+
+func statusErrorKind(statusCode int) ApiErrorKind {
+	switch {
+	case statusCode == 401 || statusCode == 403:
+		return ApiErrorAuth
+	case statusCode == 400 || (statusCode >= 300 && statusCode < 400):
+		return ApiErrorNotLeader
+	case statusCode >= 500:
+		return ApiErrorServer
+	}
+	return ApiErrorUnexpectedStatus
+}
+
+// transportError wraps err of a failed request unless it already is a
+// DroveApiError, as returned when no token could be fetched.
+func transportError(host, path string, err error) error {
+	var apiErr *DroveApiError
+	if errors.As(err, &apiErr) {
+		return apiErr
+	}
+	return &DroveApiError{Kind: ApiErrorTransport, Host: host, Path: path, Err: err}
+}
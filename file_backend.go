@@ -0,0 +1,88 @@
+package drovedns
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"sigs.k8s.io/yaml"
+)
+
+// fileBackend serves apps from a JSON or YAML file in the schema of the drove
+// endpoints api, for test environments and sites without a controller.
+type fileBackend struct {
+	path     string
+	interval time.Duration
+	mutex    sync.Mutex
+	stamp    fileStamp
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+func newFileBackend(path string, interval time.Duration) *fileBackend {
+	return &fileBackend{path: path, interval: interval, done: make(chan struct{})}
+}
+
+func (b *fileBackend) FetchApps() (*DroveAppsResponse, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	info, err := os.Stat(b.path)
+	if err != nil {
+		return nil, err
+	}
+	content, err := os.ReadFile(b.path)
+	if err != nil {
+		return nil, err
+	}
+	if len(bytes.TrimSpace(content)) == 0 {
+		// Most likely caught while the file is rewritten in place
+		return nil, fmt.Errorf("Apps file %s is empty", b.path)
+	}
+	apps := &DroveAppsResponse{}
+	if err := yaml.Unmarshal(content, apps); err != nil {
+		return nil, fmt.Errorf("Unable to parse apps file %s: %v", b.path, err)
+	}
+	if apps.Status != "" && apps.Status != "SUCCESS" {
+		return nil, fmt.Errorf("Apps file %s has status %s", b.path, apps.Status)
+	}
+	b.stamp = fileStamp{info.ModTime(), info.Size()}
+	return apps, nil
+}
+
+func (b *fileBackend) Healthy() bool {
+	_, err := os.Stat(b.path)
+	return err == nil
+}
+
+func (b *fileBackend) Stop() {
+	b.stopOnce.Do(func() { close(b.done) })
+}
+
+// Watch checks the file for changes every interval.
+func (b *fileBackend) Watch(listener BackendListener) {
+	go func() {
+		ticker := time.NewTicker(b.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-b.done:
+				return
+			case <-ticker.C:
+			}
+			info, err := os.Stat(b.path)
+			if err != nil {
+				log.Warningf("Unable to check apps file %s: %v", b.path, err)
+				continue
+			}
+			b.mutex.Lock()
+			changed := b.stamp != fileStamp{info.ModTime(), info.Size()}
+			b.mutex.Unlock()
+			if changed {
+				log.Debugf("Apps file %s changed", b.path)
+				listener.Changed()
+			}
+		}
+	}()
+}
@@ -0,0 +1,108 @@
+package drovedns
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+const DEFAULT_GUARD_OVERRIDE_AFTER int = 3
+
+type SnapshotGuardConfig struct {
+	// MaxRemovalPercent is the largest share of apps or hosts a single snapshot
+	// may remove. 0 disables the guard.
+	MaxRemovalPercent float64
+	// OverrideAfter accepts a held snapshot once that many consecutive fetches
+	// returned the same content. 0 never overrides.
+	OverrideAfter int
+}
+
+// snapshotGuard refuses snapshots removing too many apps or hosts at once, which
+// usually points to a controller bug rather than a real change. It is only used
+// from the sync loop and is not safe for concurrent use.
+type snapshotGuard struct {
+	config            SnapshotGuardConfig
+	heldFingerprint   uint64
+	consistentFetches int
+}
+
+func (g *snapshotGuard) allow(prev map[string]DroveApp, next map[string]DroveApp) bool {
+	if g.config.MaxRemovalPercent <= 0 || len(prev) == 0 {
+		g.reset()
+		return true
+	}
+	diff := diffApps(prev, next)
+	appsRemoved, hostsRemoved, totalHosts := len(diff.AppsRemoved), diff.HostsRemoved(), countHosts(prev)
+	appsPercent := percent(appsRemoved, len(prev))
+	hostsPercent := percent(hostsRemoved, totalHosts)
+	if appsPercent <= g.config.MaxRemovalPercent && hostsPercent <= g.config.MaxRemovalPercent {
+		g.reset()
+		return true
+	}
+
+	fingerprint := appsFingerprint(next)
+	if fingerprint == g.heldFingerprint {
+		g.consistentFetches++
+	} else {
+		g.heldFingerprint = fingerprint
+		g.consistentFetches = 1
+	}
+	if g.config.OverrideAfter > 0 && g.consistentFetches >= g.config.OverrideAfter {
+		log.Warningf("Accepting snapshot removing %.1f%% apps and %.1f%% hosts after %d consistent fetches", appsPercent, hostsPercent, g.consistentFetches)
+		g.reset()
+		return true
+	}
+
+	DroveSnapshotRejected.Inc()
+	DroveSnapshotHeld.Set(1)
+	log.Warningf("Holding previous snapshot, new one removes %d/%d apps (%.1f%%) and %d/%d hosts (%.1f%%) above the %.1f%% limit, consistent fetches %d/%d",
+		appsRemoved, len(prev), appsPercent, hostsRemoved, totalHosts, hostsPercent, g.config.MaxRemovalPercent, g.consistentFetches, g.config.OverrideAfter)
+	return false
+}
+
+// holding reports whether a snapshot is currently held back.
+func (g *snapshotGuard) holding() bool {
+	return g.consistentFetches > 0
+}
+
+func (g *snapshotGuard) reset() {
+	g.heldFingerprint = 0
+	g.consistentFetches = 0
+	DroveSnapshotHeld.Set(0)
+}
+
+func countHosts(apps map[string]DroveApp) int {
+	count := 0
+	for _, app := range apps {
+		count += len(app.Hosts)
+	}
+	return count
+}
+
+func appsFingerprint(apps map[string]DroveApp) uint64 {
+	keys := make([]string, 0, len(apps))
+	for vhost, app := range apps {
+		for _, h := range app.Hosts {
+			keys = append(keys, vhost+"/"+hostKey(h))
+		}
+		keys = append(keys, vhost)
+	}
+	sort.Strings(keys)
+	hash := fnv.New64a()
+	for _, k := range keys {
+		hash.Write([]byte(k))
+		hash.Write([]byte{0})
+	}
+	return hash.Sum64()
+}
+
+func hostKey(h DroveServiceHost) string {
+	return h.Host + ":" + strconv.Itoa(int(h.Port))
+}
+
+func percent(part int, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return 100 * float64(part) / float64(total)
+}
@@ -15,44 +15,75 @@ import (
 // Example is an example plugin to show how to write a plugin.
 type DroveHandler struct {
 	DroveEndpoints *DroveEndpoints
-	Next           plugin.Handler
+	Readiness      ReadinessConfig
+	// Zones the plugin is authoritative for, empty means all names
+	Zones plugin.Zones
+	// PackedResponses writes answers from the packed replies of the snapshot
+	// when there is no next plugin to combine them with, the query has no EDNS
+	// and the reply fits the client's buffer
+	PackedResponses bool
+	// Cache holds replies to queries for vhosts, nil if disabled
+	Cache *responseCache
+	Next  plugin.Handler
 }
 
-func NewDroveHandler(droveClient IDroveClient) *DroveHandler {
-	return &DroveHandler{DroveEndpoints: newDroveEndpoints(droveClient)}
+func NewDroveHandler(droveClient IDroveClient, config DroveConfig) *DroveHandler {
+	return NewBackendHandler(newDroveBackend(droveClient, config.Sync.withDefaults()), config)
+}
 
+// NewBackendHandler serves the apps of any Backend.
+func NewBackendHandler(backend Backend, config DroveConfig) *DroveHandler {
+	handler := &DroveHandler{DroveEndpoints: newBackendEndpoints(backend, config), Readiness: config.Readiness, Zones: config.Zones,
+		PackedResponses: config.PackedResponses}
+	if config.ResponseCacheSize > 0 {
+		handler.Cache = newResponseCache(config.ResponseCacheSize)
+		handler.DroveEndpoints.Subscribe(func(diff SnapshotDiff) {
+			handler.Cache.invalidate(diff.ChangedVhosts())
+		})
+	}
+	return handler
 }
 func (e *DroveHandler) Name() string { return "drove" }
 
 func (e *DroveHandler) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
 
-	a := new(dns.Msg)
-	if e.DroveEndpoints.getApps() == nil {
-		return dns.RcodeServerFailure, fmt.Errorf("Drove DNS not ready")
-	}
+	index := e.DroveEndpoints.currentIndex()
 	if len(r.Question) == 0 {
+		if !index.ready() {
+			return dns.RcodeServerFailure, fmt.Errorf("Drove DNS not ready")
+		}
 		return plugin.NextOrFailure(e.Name(), e.Next, ctx, w, r)
 	}
-	app := e.DroveEndpoints.searchApps(r.Question[0].Name)
-	if app != nil {
-
-		a.SetReply(r)
-		a.Authoritative = true
-
+	if !index.ready() {
+		return e.serveNotReady(ctx, w, r)
+	}
+	if e.PackedResponses && e.Next == nil && r.IsEdns0() == nil {
 		state := request.Request{W: w, Req: r}
-
-		srv := make([]dns.RR, len(app.Hosts))
-
-		for i, h := range app.Hosts {
-			srv[i] = &dns.SRV{Hdr: dns.RR_Header{Name: state.QName(), Rrtype: dns.TypeSRV, Class: state.QClass(), Ttl: 30},
-				Port:     uint16(h.Port),
-				Target:   h.Host + ".",
-				Weight:   1,
-				Priority: 1,
+		buf := replyBuffers.Get().(*[]byte)
+		defer replyBuffers.Put(buf)
+		// Replies too large for the client need truncating, which is left to
+		// the server's ScrubWriter on the dns.Msg path
+		if reply := index.packedReply(r, *buf); reply != nil && len(reply) <= state.Size() {
+			*buf = reply
+			w.Write(reply)
+			return dns.RcodeSuccess, nil
+		}
+	}
+	a := new(dns.Msg)
+	question := r.Question[0]
+	if index.hasRecords(question.Name) {
+		if e.Cache != nil {
+			if reply := e.Cache.get(r, index.vhostGeneration(question.Name)); reply != nil {
+				w.WriteMsg(reply)
+				return dns.RcodeSuccess, nil
 			}
 		}
 
-		if state.QType() == dns.TypeSRV {
+		a.SetReply(r)
+		a.Authoritative = true
+
+		srv := index.lookup(question.Name, question.Qclass)
+		if question.Qtype == dns.TypeSRV {
 			a.Answer = srv
 		} else {
 			a.Extra = srv
@@ -61,7 +92,19 @@ func (e *DroveHandler) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dn
 
 	if len(a.Answer) > 0 || len(a.Extra) > 0 {
 		if e.Next != nil {
-			return plugin.NextOrFailure(e.Name(), e.Next, ctx, &CombiningResponseWriter{w, a}, r)
+			combining := &CombiningResponseWriter{ResponseWriter: w, answer: a}
+			if e.Cache != nil {
+				generation := index.vhostGeneration(question.Name)
+				combining.written = func(res *dns.Msg) {
+					// The next plugin, or plugins before this one, may still modify res
+					e.Cache.put(r, res.Copy(), generation)
+				}
+			}
+			return plugin.NextOrFailure(e.Name(), e.Next, ctx, combining, r)
+		}
+		if e.Cache != nil {
+			// Writers down the chain truncate a and add the OPT record to it
+			e.Cache.put(r, a.Copy(), index.vhostGeneration(question.Name))
 		}
 		w.WriteMsg(a)
 		return dns.RcodeSuccess, nil
@@ -72,16 +115,36 @@ func (e *DroveHandler) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dn
 	return plugin.NextOrFailure(e.Name(), e.Next, ctx, w, r)
 }
 
+// serveNotReady answers before the first snapshot was loaded. Names outside the
+// plugin's zones always go to the next plugin.
+func (e *DroveHandler) serveNotReady(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+	if len(e.Zones) > 0 && e.Zones.Matches(r.Question[0].Name) == "" {
+		return plugin.NextOrFailure(e.Name(), e.Next, ctx, w, r)
+	}
+	switch e.Readiness.NotReady {
+	case NOT_READY_FALLTHROUGH:
+		return plugin.NextOrFailure(e.Name(), e.Next, ctx, w, r)
+	case NOT_READY_REFUSE:
+		return dns.RcodeRefused, nil
+	}
+	return dns.RcodeServerFailure, fmt.Errorf("Drove DNS not ready")
+}
+
 // Name implements the Handler interface.
 type CombiningResponseWriter struct {
 	dns.ResponseWriter
 	answer *dns.Msg
+	// written is called with the combined response if set
+	written func(res *dns.Msg)
 }
 
 func (w *CombiningResponseWriter) WriteMsg(res *dns.Msg) error {
 
 	res.Answer = append(res.Answer, w.answer.Answer...)
 	res.Extra = append(res.Extra, w.answer.Extra...)
+	if w.written != nil {
+		w.written(res)
+	}
 	return w.ResponseWriter.WriteMsg(res)
 
 }
@@ -3,10 +3,13 @@ package drovedns
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"net"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/coredns/coredns/request"
 	"github.com/miekg/dns"
 	"github.com/stretchr/testify/assert"
 )
@@ -15,7 +18,7 @@ type MockDroveClient struct{}
 
 func (*MockDroveClient) FetchApps() (*DroveAppsResponse, error) {
 	apps := &DroveAppsResponse{}
-	json.Unmarshal([]byte(`{"status": "ok", "message": "ok", "data":[{"appId": "PS", "vhost": "example.com", "tags": {}, "hosts":[{"host": "host", "port": 1234, "portType": "http"}]}]}`), apps)
+	json.Unmarshal([]byte(`{"status": "SUCCESS", "message": "ok", "data":[{"appId": "PS", "vhost": "example.com", "tags": {}, "hosts":[{"host": "host", "port": 1234, "portType": "http"}]}]}`), apps)
 	return apps, nil
 }
 
@@ -25,10 +28,25 @@ func (*MockDroveClient) FetchRecentEvents(sync *CurrSyncPoint) (*DroveEventSumma
 	return &DroveEventSummary{eventCount, 1}, nil
 }
 
-func (*MockDroveClient) PollEvents(callback func(event *DroveEventSummary)) {
+func (*MockDroveClient) PollEvents(callback func(event *DroveEventSummary), resync func()) {
 
 }
 
+func (*MockDroveClient) PollEventDetails(callback func(events []*DroveEvent), resync func()) {
+
+}
+
+func (*MockDroveClient) StreamEvents(callback func(event *DroveEvent)) error {
+	return ErrStreamUnsupported
+}
+
+func (*MockDroveClient) Healthy() bool {
+	return true
+}
+
+func (*MockDroveClient) Stop() {
+}
+
 type MockResponseWriter struct {
 	dns.ResponseWriter
 	validator   func(ms *dns.Msg)
@@ -42,9 +60,17 @@ func (w *MockResponseWriter) WriteMsg(res *dns.Msg) error {
 
 }
 
+func (w *MockResponseWriter) Write(buf []byte) (int, error) {
+	res := new(dns.Msg)
+	if err := res.Unpack(buf); err != nil {
+		return 0, err
+	}
+	return len(buf), w.WriteMsg(res)
+}
+
 func TestServeDNSNotReady(t *testing.T) {
 
-	handler := DroveHandler{DroveEndpoints: newDroveEndpoints(&MockDroveClient{})}
+	handler := DroveHandler{DroveEndpoints: newDroveEndpoints(&MockDroveClient{}, NewDroveConfig())}
 	writer := &MockResponseWriter{
 		validator: func(res *dns.Msg) {
 			assert.Equal(t, 1, len(res.Answer), "One Answer should be returned")
@@ -59,7 +85,7 @@ func TestServeDNSNotReady(t *testing.T) {
 
 }
 func TestServeDNSAnswer(t *testing.T) {
-	handler := NewDroveHandler(&MockDroveClient{})
+	handler := NewDroveHandler(&MockDroveClient{}, NewDroveConfig())
 	for !handler.Ready() {
 		time.Sleep(1)
 	}
@@ -78,7 +104,7 @@ func TestServeDNSAnswer(t *testing.T) {
 }
 
 func TestServeDNSAdditional(t *testing.T) {
-	handler := NewDroveHandler(&MockDroveClient{})
+	handler := NewDroveHandler(&MockDroveClient{}, NewDroveConfig())
 	for !handler.Ready() {
 		time.Sleep(1)
 	}
@@ -97,7 +123,7 @@ func TestServeDNSAdditional(t *testing.T) {
 }
 
 func TestServeDNSNoMatchingApp(t *testing.T) {
-	handler := NewDroveHandler(&MockDroveClient{})
+	handler := NewDroveHandler(&MockDroveClient{}, NewDroveConfig())
 	for !handler.Ready() {
 		time.Sleep(1)
 	}
@@ -130,7 +156,7 @@ func (h *MockHandler) Name() string {
 	return "MOCK"
 }
 func TestServeDNSForwarding(t *testing.T) {
-	handler := NewDroveHandler(&MockDroveClient{})
+	handler := NewDroveHandler(&MockDroveClient{}, NewDroveConfig())
 	mockNextHandler := MockHandler{}
 	handler.Next = &mockNextHandler
 	for !handler.Ready() {
@@ -147,3 +173,395 @@ func TestServeDNSForwarding(t *testing.T) {
 
 	assert.Equal(t, 1, mockNextHandler.callCounter, "Next handler should be called")
 }
+
+type unhealthyMockDroveClient struct {
+	MockDroveClient
+}
+
+func (*unhealthyMockDroveClient) Healthy() bool {
+	return false
+}
+
+func TestReadiness(t *testing.T) {
+	config := NewDroveConfig()
+	config.Readiness = ReadinessConfig{MaxSnapshotAge: time.Minute}
+	handler := NewDroveHandler(&MockDroveClient{}, config)
+	assert.Eventually(t, handler.Ready, time.Second, 10*time.Millisecond)
+
+	handler.DroveEndpoints.lastSnapshot.Store(time.Now().Add(-2 * time.Minute).UnixNano())
+	assert.False(t, handler.Ready(), "Stale snapshot should not be ready")
+
+	config.Readiness = ReadinessConfig{RequireHealthyController: true}
+	handler = NewDroveHandler(&unhealthyMockDroveClient{}, config)
+	assert.Eventually(t, func() bool { return handler.DroveEndpoints.getApps() != nil }, time.Second, 10*time.Millisecond)
+	assert.False(t, handler.Ready(), "No healthy controller should not be ready")
+}
+
+type failingMockDroveClient struct {
+	MockDroveClient
+}
+
+func (*failingMockDroveClient) FetchApps() (*DroveAppsResponse, error) {
+	return nil, ErrTransport
+}
+
+func TestServeDNSNotReadyPolicy(t *testing.T) {
+	query := func(name string) *dns.Msg {
+		return &dns.Msg{Question: []dns.Question{{Name: name, Qtype: dns.TypeSRV, Qclass: dns.ClassINET}}}
+	}
+	tests := []struct {
+		policy     string
+		name       string
+		code       int
+		nextCalled bool
+	}{
+		{NOT_READY_SERVFAIL, "app.drove.", dns.RcodeServerFailure, false},
+		{NOT_READY_REFUSE, "app.drove.", dns.RcodeRefused, false},
+		{NOT_READY_FALLTHROUGH, "app.drove.", dns.RcodeSuccess, true},
+		{NOT_READY_SERVFAIL, "example.org.", dns.RcodeSuccess, true},
+		{NOT_READY_REFUSE, "example.org.", dns.RcodeSuccess, true},
+	}
+	for _, test := range tests {
+		config := NewDroveConfig()
+		config.Readiness.NotReady = test.policy
+		config.Zones = []string{"drove."}
+		handler := NewDroveHandler(&failingMockDroveClient{}, config)
+		next := &MockHandler{}
+		handler.Next = next
+		code, _ := handler.ServeDNS(context.Background(), &MockResponseWriter{validator: func(*dns.Msg) {}}, query(test.name))
+		assert.Equal(t, test.code, code, "%s %s", test.policy, test.name)
+		assert.Equal(t, test.nextCalled, next.callCounter == 1, "%s %s", test.policy, test.name)
+	}
+}
+
+func TestServeDNSPacked(t *testing.T) {
+	endpoints := &DroveEndpoints{guard: &snapshotGuard{}}
+	endpoints.setApps(appsSnapshot(map[string]int{"a.drove": 3, "empty": 0}))
+	packed := DroveHandler{DroveEndpoints: endpoints, PackedResponses: true}
+	unpacked := DroveHandler{DroveEndpoints: endpoints}
+	queries := []*dns.Msg{
+		{MsgHdr: dns.MsgHdr{Id: 4242, RecursionDesired: true}, Question: []dns.Question{{Name: "a.drove.", Qtype: dns.TypeSRV, Qclass: dns.ClassINET}}},
+		{MsgHdr: dns.MsgHdr{Id: 7, CheckingDisabled: true}, Question: []dns.Question{{Name: "a.drove.", Qtype: dns.TypeA, Qclass: dns.ClassINET}}},
+		{MsgHdr: dns.MsgHdr{Id: 9}, Question: []dns.Question{{Name: "a.drove.", Qtype: dns.TypeSRV, Qclass: dns.ClassCHAOS}}},
+	}
+	for _, query := range queries {
+		var expected, actual []byte
+		code, err := unpacked.ServeDNS(context.Background(), &packingResponseWriter{packed: &expected}, query)
+		assert.Equal(t, dns.RcodeSuccess, code)
+		assert.Nil(t, err)
+		code, err = packed.ServeDNS(context.Background(), &packingResponseWriter{packed: &actual}, query)
+		assert.Equal(t, dns.RcodeSuccess, code)
+		assert.Nil(t, err)
+		assert.NotEmpty(t, actual)
+		assert.Equal(t, expected, actual, "Packed reply should match the built one for %s", query.Question[0].String())
+	}
+
+	writer := &MockResponseWriter{validator: func(res *dns.Msg) {}}
+	code, _ := packed.ServeDNS(context.Background(), writer, &dns.Msg{Question: []dns.Question{{Name: "empty.", Qtype: dns.TypeSRV, Qclass: dns.ClassINET}}})
+	assert.Equal(t, dns.RcodeServerFailure, code, "Vhosts without hosts go to the next plugin")
+	assert.Equal(t, 0, writer.callCounter)
+}
+
+func TestServeDNSPackedScrubbed(t *testing.T) {
+	endpoints := &DroveEndpoints{guard: &snapshotGuard{}}
+	endpoints.setApps(appsSnapshot(map[string]int{"large.drove": 40}))
+	handler := DroveHandler{DroveEndpoints: endpoints, PackedResponses: true}
+	var packed []byte
+	serve := func(query *dns.Msg, tcp bool) *dns.Msg {
+		writer := &packingResponseWriter{packed: &packed, tcp: tcp}
+		code, err := handler.ServeDNS(context.Background(), request.NewScrubWriter(query, writer), query)
+		assert.Equal(t, dns.RcodeSuccess, code)
+		assert.Nil(t, err)
+		assert.Equal(t, 1, writer.writes)
+		res := new(dns.Msg)
+		assert.NoError(t, res.Unpack(packed))
+		return res
+	}
+
+	query := new(dns.Msg).SetQuestion("large.drove.", dns.TypeSRV)
+	res := serve(query, false)
+	assert.True(t, res.Truncated, "Replies larger than 512 bytes should be truncated over UDP")
+	assert.LessOrEqual(t, len(packed), dns.MinMsgSize)
+
+	res = serve(query, true)
+	assert.False(t, res.Truncated)
+	assert.Equal(t, 40, len(res.Answer), "TCP replies should be complete")
+
+	query = new(dns.Msg).SetQuestion("large.drove.", dns.TypeSRV)
+	query.SetEdns0(4096, true)
+	res = serve(query, false)
+	assert.False(t, res.Truncated)
+	assert.Equal(t, 40, len(res.Answer))
+	if assert.NotNil(t, res.IsEdns0(), "The OPT record should be echoed") {
+		assert.True(t, res.IsEdns0().Do())
+	}
+}
+
+// modifyRecords changes records in place like the cache plugin sets TTLs and
+// rewrite rewrites answers.
+func modifyRecords(res *dns.Msg) {
+	for _, section := range [][]dns.RR{res.Answer, res.Extra} {
+		for _, rr := range section {
+			rr.Header().Name = "rewritten.example."
+			rr.Header().Ttl = 5
+			if srv, ok := rr.(*dns.SRV); ok {
+				srv.Target = "rewritten.example."
+			}
+		}
+	}
+}
+
+func TestServeDNSModifyingWriter(t *testing.T) {
+	endpoints := &DroveEndpoints{guard: &snapshotGuard{}}
+	endpoints.setApps(appsSnapshot(map[string]int{"a": 3}))
+	for _, handler := range []*DroveHandler{{DroveEndpoints: endpoints}, {DroveEndpoints: endpoints, Cache: newResponseCache(10)}} {
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for _, qtype := range []uint16{dns.TypeSRV, dns.TypeA, dns.TypeSRV, dns.TypeAAAA} {
+					writer := &MockResponseWriter{validator: modifyRecords}
+					handler.ServeDNS(context.Background(), writer, new(dns.Msg).SetQuestion("a.", qtype))
+				}
+			}()
+		}
+		wg.Wait()
+
+		writer := &MockResponseWriter{validator: func(res *dns.Msg) {
+			assert.Equal(t, 3, len(res.Answer))
+			for _, rr := range res.Answer {
+				assert.Equal(t, "a.", rr.Header().Name, "Records modified by writers should not leak into later replies")
+				assert.Equal(t, SRV_TTL, rr.Header().Ttl)
+				assert.NotEqual(t, "rewritten.example.", rr.(*dns.SRV).Target)
+			}
+		}}
+		handler.ServeDNS(context.Background(), writer, new(dns.Msg).SetQuestion("a.", dns.TypeSRV))
+		assert.Equal(t, 1, writer.callCounter)
+	}
+}
+
+// answeringMockHandler answers every query with an A record.
+type answeringMockHandler struct {
+	callCounter int
+}
+
+func (h *answeringMockHandler) ServeDNS(c context.Context, rw dns.ResponseWriter, r *dns.Msg) (int, error) {
+	h.callCounter += 1
+	res := new(dns.Msg)
+	res.SetReply(r)
+	res.Answer = append(res.Answer, &dns.A{Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.IPv4(1, 1, 1, 1)})
+	rw.WriteMsg(res)
+	return dns.RcodeSuccess, nil
+}
+
+func (h *answeringMockHandler) Name() string {
+	return "MOCK"
+}
+
+func TestServeDNSResponseCache(t *testing.T) {
+	endpoints := &DroveEndpoints{guard: &snapshotGuard{}}
+	endpoints.setApps(appsSnapshot(map[string]int{"a": 2, "b": 1}))
+	next := &answeringMockHandler{}
+	handler := DroveHandler{DroveEndpoints: endpoints, Cache: newResponseCache(10), Next: next}
+	query := func(name string, id uint16) *dns.Msg {
+		var reply *dns.Msg
+		writer := &MockResponseWriter{validator: func(res *dns.Msg) { reply = res }}
+		code, err := handler.ServeDNS(context.Background(), writer, &dns.Msg{MsgHdr: dns.MsgHdr{Id: id}, Question: []dns.Question{{Name: name, Qtype: dns.TypeA, Qclass: dns.ClassINET}}})
+		assert.Equal(t, dns.RcodeSuccess, code)
+		assert.Nil(t, err)
+		return reply
+	}
+
+	first := query("a.", 1)
+	assert.Equal(t, 1, len(first.Answer))
+	assert.Equal(t, 2, len(first.Extra))
+	cached := query("a.", 2)
+	assert.Equal(t, 1, next.callCounter, "Cached reply should not go to the next plugin")
+	assert.Equal(t, uint16(2), cached.Id)
+	assert.Equal(t, first.Extra, cached.Extra)
+
+	query("b.", 3)
+	assert.Equal(t, 2, next.callCounter)
+	endpoints.setApps(appsSnapshot(map[string]int{"a": 3, "b": 1}))
+	assert.Equal(t, 3, len(query("a.", 4).Extra), "Reply should be rebuilt once hosts of the vhost changed")
+	assert.Equal(t, 3, next.callCounter)
+	query("b.", 5)
+	assert.Equal(t, 3, next.callCounter, "Reply of unchanged vhosts should stay cached")
+
+	handler.Cache.invalidate([]string{"b."})
+	query("b.", 6)
+	assert.Equal(t, 4, next.callCounter)
+
+	handler.Next = nil
+	endpoints.setApps(appsSnapshot(map[string]int{"a": 1, "b": 1}))
+	assert.Equal(t, 1, len(query("a.", 7).Extra))
+	assert.Equal(t, uint16(8), query("a.", 8).Id)
+	assert.Equal(t, 1, len(handler.Cache.entries[responseCacheKey{name: "a.", qtype: dns.TypeA, qclass: dns.ClassINET}].msg.Extra))
+}
+
+func TestServeDNSResponseCacheScrubbed(t *testing.T) {
+	endpoints := &DroveEndpoints{guard: &snapshotGuard{}}
+	endpoints.setApps(appsSnapshot(map[string]int{"large.drove": 40}))
+	handler := DroveHandler{DroveEndpoints: endpoints, Cache: newResponseCache(10)}
+	serve := func(query *dns.Msg, tcp bool) *dns.Msg {
+		var packed []byte
+		writer := &packingResponseWriter{packed: &packed, tcp: tcp}
+		code, err := handler.ServeDNS(context.Background(), request.NewScrubWriter(query, writer), query)
+		assert.Equal(t, dns.RcodeSuccess, code)
+		assert.Nil(t, err)
+		res := new(dns.Msg)
+		assert.NoError(t, res.Unpack(packed))
+		return res
+	}
+	key := responseCacheKey{name: "large.drove.", qtype: dns.TypeSRV, qclass: dns.ClassINET}
+
+	query := new(dns.Msg).SetQuestion("large.drove.", dns.TypeSRV)
+	assert.True(t, serve(query, false).Truncated)
+	cached := handler.Cache.entries[key].msg
+	assert.False(t, cached.Truncated, "Truncating the reply should not truncate the cached one")
+	assert.Equal(t, 40, len(cached.Answer))
+
+	assert.True(t, serve(query, false).Truncated, "Cached replies should be truncated over UDP")
+	res := serve(query, true)
+	assert.False(t, res.Truncated)
+	assert.Equal(t, 40, len(res.Answer), "Cached replies should be complete over TCP")
+
+	query = new(dns.Msg).SetQuestion("large.drove.", dns.TypeSRV)
+	query.SetEdns0(4096, false)
+	for i := 0; i < 2; i++ {
+		res = serve(query, false)
+		assert.False(t, res.Truncated)
+		assert.NotNil(t, res.IsEdns0(), "The OPT record should be echoed")
+	}
+	assert.Nil(t, handler.Cache.entries[key].msg.IsEdns0(), "The OPT record should not be added to the cached reply")
+}
+
+func TestResponseCacheCopies(t *testing.T) {
+	cache := newResponseCache(10)
+	r := new(dns.Msg).SetQuestion("a.", dns.TypeSRV)
+	r.SetEdns0(4096, true)
+	res := new(dns.Msg).SetReply(r)
+	res.Answer = srvRecords("a.", dns.ClassINET, []DroveServiceHost{{Host: "host", Port: 80}, {Host: "other", Port: 80}})
+	res.SetEdns0(4096, true)
+	cache.put(r, res, 1)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(size uint16) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				reply := cache.get(r, 1)
+				reply.IsEdns0().SetUDPSize(size)
+				reply.Question[0].Name = "b."
+				modifyRecords(reply)
+			}
+		}(uint16(1024 * (i + 1)))
+	}
+	wg.Wait()
+	assert.Equal(t, uint16(4096), res.IsEdns0().UDPSize())
+	assert.Equal(t, "a.", res.Question[0].Name)
+	for _, rr := range res.Answer {
+		assert.Equal(t, "a.", rr.Header().Name)
+		assert.Equal(t, SRV_TTL, rr.Header().Ttl)
+	}
+}
+
+func TestResponseCacheCapacity(t *testing.T) {
+	cache := newResponseCache(2)
+	for _, name := range []string{"a.", "b.", "c."} {
+		r := new(dns.Msg).SetQuestion(name, dns.TypeSRV)
+		res := new(dns.Msg).SetReply(r)
+		res.Answer = srvRecords(name, dns.ClassINET, []DroveServiceHost{{Host: "host", Port: 80}})
+		cache.put(r, res, 1)
+	}
+	assert.Equal(t, 2, len(cache.entries))
+
+	r := new(dns.Msg).SetQuestion("d.", dns.TypeSRV)
+	res := new(dns.Msg).SetRcode(r, dns.RcodeNameError)
+	cache.put(r, res, 1)
+	assert.Nil(t, cache.get(r, 1), "Failures should not be cached")
+}
+
+// packingResponseWriter packs messages like the server would and keeps the
+// last reply written. Queries come over UDP unless tcp is set.
+type packingResponseWriter struct {
+	dns.ResponseWriter
+	packed *[]byte
+	tcp    bool
+	writes int
+}
+
+func (w *packingResponseWriter) RemoteAddr() net.Addr {
+	if w.tcp {
+		return &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 40000}
+	}
+	return &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 40000}
+}
+
+func (w *packingResponseWriter) WriteMsg(res *dns.Msg) error {
+	buf, err := res.Pack()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(buf)
+	return err
+}
+
+func (w *packingResponseWriter) Write(buf []byte) (int, error) {
+	w.writes++
+	if w.packed != nil {
+		*w.packed = append((*w.packed)[:0], buf...)
+	}
+	return len(buf), nil
+}
+
+// BenchmarkServeDNS answers queries for 1000 vhosts with 10 hosts each,
+// reporting queries per second and allocations per query. Replies are packed
+// as the server would.
+func BenchmarkServeDNS(b *testing.B) {
+	hostsByVhost := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		hostsByVhost[fmt.Sprintf("app-%d.drove", i)] = 10
+	}
+	run := func(b *testing.B, packed bool, qtype uint16, updating bool) {
+		endpoints := &DroveEndpoints{guard: &snapshotGuard{}}
+		endpoints.setApps(appsSnapshot(hostsByVhost))
+		handler := DroveHandler{DroveEndpoints: endpoints, PackedResponses: packed}
+		done := make(chan struct{})
+		defer close(done)
+		if updating {
+			go func() {
+				for {
+					select {
+					case <-done:
+						return
+					default:
+						endpoints.setApps(appsSnapshot(hostsByVhost))
+					}
+				}
+			}()
+		}
+		b.ReportAllocs()
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			query := &dns.Msg{Question: []dns.Question{{Name: "app-42.drove.", Qtype: qtype, Qclass: dns.ClassINET}}}
+			writer := &packingResponseWriter{}
+			for pb.Next() {
+				if code, _ := handler.ServeDNS(context.Background(), writer, query); code != dns.RcodeSuccess {
+					b.Fatalf("Unexpected rcode %d", code)
+				}
+			}
+		})
+		b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "queries/s")
+	}
+	for _, mode := range []struct {
+		name   string
+		packed bool
+	}{{"packed", true}, {"message", false}} {
+		b.Run(mode.name+"/srv", func(b *testing.B) { run(b, mode.packed, dns.TypeSRV, false) })
+		b.Run(mode.name+"/additional", func(b *testing.B) { run(b, mode.packed, dns.TypeA, false) })
+		b.Run(mode.name+"/updating", func(b *testing.B) { run(b, mode.packed, dns.TypeSRV, true) })
+	}
+}
@@ -0,0 +1,204 @@
+package drovedns
+
+import (
+	"encoding/binary"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// SRV_TTL is the TTL of the SRV records served.
+const SRV_TTL uint32 = 30
+
+// MSG_HEADER_SIZE is the size of the DNS message header preceding the question.
+const MSG_HEADER_SIZE int = 12
+
+// appIndex is an immutable view of the apps served. A new index replaces the
+// previous one as a whole, so queries read it with a single atomic load and
+// never contend with snapshot updates.
+type appIndex struct {
+	appDB   *DroveAppsResponse
+	byVhost map[string]DroveApp
+	// records holds the SRV records of every vhost in class IN. They are only
+	// templates, every response gets copies to be modified by writers.
+	records map[string][]dns.RR
+	// packed holds the replies of every vhost with hosts, ready to be written
+	packed map[string]*packedReplies
+	// generation counts the indexes built, generations holds the generation in
+	// which the hosts of every vhost last changed
+	generation  uint64
+	generations map[string]uint64
+}
+
+// packedReplies are the packed replies of a vhost to a class IN query. srv
+// carries the records as answers, extra as additional records for any other
+// query type.
+type packedReplies struct {
+	srv   []byte
+	extra []byte
+	// qtypeOffset is where the question type follows the question name
+	qtypeOffset int
+}
+
+// newAppIndex builds the index of appsByVhost. Records and generations of
+// vhosts whose hosts are unchanged since prev are carried over.
+func newAppIndex(appDB *DroveAppsResponse, appsByVhost map[string]DroveApp, prev *appIndex) *appIndex {
+	index := &appIndex{
+		appDB:       appDB,
+		byVhost:     appsByVhost,
+		records:     make(map[string][]dns.RR, len(appsByVhost)),
+		packed:      make(map[string]*packedReplies, len(appsByVhost)),
+		generation:  1,
+		generations: make(map[string]uint64, len(appsByVhost)),
+	}
+	if prev != nil {
+		index.generation = prev.generation + 1
+	}
+	for vhost, app := range appsByVhost {
+		if prev != nil {
+			if prevApp, ok := prev.byVhost[vhost]; ok && sameHosts(prevApp.Hosts, app.Hosts) {
+				index.records[vhost] = prev.records[vhost]
+				index.generations[vhost] = prev.generations[vhost]
+				if packed, ok := prev.packed[vhost]; ok {
+					index.packed[vhost] = packed
+				}
+				continue
+			}
+		}
+		index.records[vhost] = srvRecords(vhost, dns.ClassINET, app.Hosts)
+		index.generations[vhost] = index.generation
+		if len(app.Hosts) == 0 {
+			continue
+		}
+		packed, err := packReplies(vhost, index.records[vhost])
+		if err != nil {
+			log.Warningf("Unable to pack replies for %s, building them per query: %v", vhost, err)
+			continue
+		}
+		index.packed[vhost] = packed
+	}
+	return index
+}
+
+// packReplies packs the replies to queries for vhost. They only differ from the
+// actual reply in the header flags taken from the query, its ID and question type.
+func packReplies(vhost string, srv []dns.RR) (*packedReplies, error) {
+	reply := &dns.Msg{
+		MsgHdr:   dns.MsgHdr{Response: true, Authoritative: true, Opcode: dns.OpcodeQuery},
+		Question: []dns.Question{{Name: vhost, Qtype: dns.TypeSRV, Qclass: dns.ClassINET}},
+		Answer:   srv,
+	}
+	packed := &packedReplies{}
+	var err error
+	if packed.srv, err = reply.Pack(); err != nil {
+		return nil, err
+	}
+	reply.Answer, reply.Extra = nil, srv
+	if packed.extra, err = reply.Pack(); err != nil {
+		return nil, err
+	}
+	if _, packed.qtypeOffset, err = dns.UnpackDomainName(packed.srv, MSG_HEADER_SIZE); err != nil {
+		return nil, err
+	}
+	return packed, nil
+}
+
+// ready reports whether apps were loaded. A nil index is not ready.
+func (idx *appIndex) ready() bool {
+	return idx != nil && idx.appDB != nil
+}
+
+// vhostGeneration returns the generation in which the hosts of name last
+// changed, 0 for names not served.
+func (idx *appIndex) vhostGeneration(name string) uint64 {
+	return idx.generations[name]
+}
+
+// hasRecords reports whether name is a vhost with hosts.
+func (idx *appIndex) hasRecords(name string) bool {
+	return len(idx.records[name]) > 0
+}
+
+// lookup returns copies of the SRV records of name in class, nil if name is
+// unknown. Writers like cache and rewrite modify records in place.
+func (idx *appIndex) lookup(name string, class uint16) []dns.RR {
+	records := idx.records[name]
+	if len(records) == 0 {
+		return nil
+	}
+	if class != dns.ClassINET {
+		return srvRecords(name, class, idx.byVhost[name].Hosts)
+	}
+	srv := make([]dns.RR, len(records))
+	copies := make([]dns.SRV, len(records))
+	for i, rr := range records {
+		copies[i] = *rr.(*dns.SRV)
+		srv[i] = &copies[i]
+	}
+	return srv
+}
+
+// replyBuffers recycles the buffers packed replies are written from.
+var replyBuffers = sync.Pool{New: func() any {
+	buf := make([]byte, 0, dns.MinMsgSize)
+	return &buf
+}}
+
+// packedReply returns the reply to r copied into buf from the packed replies of
+// its vhost, or nil if r needs to be answered through a dns.Msg.
+func (idx *appIndex) packedReply(r *dns.Msg, buf []byte) []byte {
+	question := r.Question[0]
+	if r.Opcode != dns.OpcodeQuery || question.Qclass != dns.ClassINET {
+		return nil
+	}
+	packed, ok := idx.packed[question.Name]
+	if !ok {
+		return nil
+	}
+	if question.Qtype == dns.TypeSRV {
+		buf = append(buf[:0], packed.srv...)
+	} else {
+		buf = append(buf[:0], packed.extra...)
+	}
+	// Same header as set by Msg.SetReply
+	binary.BigEndian.PutUint16(buf, r.Id)
+	if r.RecursionDesired {
+		buf[2] |= 0x01
+	}
+	if r.CheckingDisabled {
+		buf[3] |= 0x10
+	}
+	binary.BigEndian.PutUint16(buf[packed.qtypeOffset:], question.Qtype)
+	return buf
+}
+
+func srvRecords(name string, class uint16, hosts []DroveServiceHost) []dns.RR {
+	srv := make([]dns.RR, len(hosts))
+	for i, h := range hosts {
+		srv[i] = &dns.SRV{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeSRV, Class: class, Ttl: SRV_TTL},
+			Port:     uint16(h.Port),
+			Target:   h.Host + ".",
+			Weight:   1,
+			Priority: 1,
+		}
+	}
+	return srv
+}
+
+// sameHosts reports whether both slices hold the same hosts in the same order.
+// Apps untouched by an instance change share their slice, as snapshots never
+// modify hosts in place.
+func sameHosts(a []DroveServiceHost, b []DroveServiceHost) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	if len(a) == 0 || &a[0] == &b[0] {
+		return true
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -35,4 +35,175 @@ var (
 		Name:      "controller_health",
 		Help:      "Drove controller health",
 	}, []string{"host"})
+
+	DroveLeader = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "leader",
+		Help:      "Drove controller currently used as leader",
+	}, []string{"host"})
+
+	DroveLeaderTerm = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "leader_term",
+		Help:      "Number of leader changes observed since startup",
+	})
+
+	DroveLeaderClaimants = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "leader_claimants",
+		Help:      "Number of controllers claiming leadership on the last health check",
+	})
+
+	DroveLeaderConflicts = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "leader_conflicts_total",
+		Help:      "Counter of health checks where more than one controller claimed leadership",
+	})
+
+	DroveProbeLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "probe_duration_seconds",
+		Buckets:   plugin.TimeBuckets,
+		Help:      "Histogram of the time taken to ping a drove controller",
+	}, []string{"host"})
+
+	DroveApiRetries = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "api_retries_total",
+		Help:      "Counter of drove api requests retried",
+	})
+
+	DroveCircuitOpen = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "circuit_open",
+		Help:      "Set to 1 while requests to a drove controller are suspended",
+	}, []string{"host"})
+
+	DroveApiErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "api_errors_total",
+		Help:      "Drove api request failures grouped by error type",
+	}, []string{"type", "host"})
+
+	DroveSnapshotRejected = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "snapshot_rejected_total",
+		Help:      "Counter of app snapshots held back for removing too many apps or hosts",
+	})
+
+	DroveSnapshotHeld = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "snapshot_held",
+		Help:      "Set to 1 while the previous app snapshot is served because the latest one was rejected",
+	})
+
+	DroveSnapshotChanges = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "snapshot_changes_total",
+		Help:      "Changes applied from drove snapshots grouped by change type",
+	}, []string{"change"})
+
+	DroveReloadsCoalesced = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "reloads_coalesced_total",
+		Help:      "Counter of event triggered reloads folded into an already pending reload",
+	})
+
+	DroveEventsReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "events_received_total",
+		Help:      "Drove events received from the event stream grouped by type",
+	}, []string{"type"})
+
+	DroveEventStreamConnected = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "event_stream_connected",
+		Help:      "Set to 1 while the drove event stream is connected",
+	})
+
+	DroveSnapshotDrift = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "snapshot_drift_total",
+		Help:      "Changes found by the periodic full resync that incremental updates missed, grouped by change type",
+	}, []string{"change"})
+
+	DroveSyncPointResets = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "sync_point_resets_total",
+		Help:      "Event sync point resets forcing a full app fetch, grouped by reason",
+	}, []string{"reason"})
+
+	DroveLastSnapshot = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "last_snapshot_timestamp_seconds",
+		Help:      "Unix time apps were last fetched or patched successfully",
+	})
+
+	DroveLastSyncAttempt = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "last_sync_attempt_timestamp_seconds",
+		Help:      "Unix time the sync loop last made progress, successful or not",
+	})
+
+	DroveTokenRefreshes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "oauth2_token_refreshes_total",
+		Help:      "OAuth2 tokens fetched from the token endpoint grouped by result",
+	}, []string{"result"})
+
+	DroveCredentialReloads = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "credential_file_loads_total",
+		Help:      "Credential files read after they changed, grouped by path",
+	}, []string{"path"})
+
+	DroveTLSReloads = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "tls_reloads_total",
+		Help:      "CA and client certificates loaded from disk, grouped by kind",
+	}, []string{"kind"})
+
+	DroveResponseSize = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "response_size_bytes",
+		Help:      "Size of drove api responses as transferred, grouped by api path",
+		Buckets:   prometheus.ExponentialBuckets(256, 4, 10),
+	}, []string{"path"})
+
+	DroveDecodeDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "decode_duration_seconds",
+		Help:      "Time spent reading and decoding drove api responses, grouped by api path",
+		Buckets:   prometheus.ExponentialBuckets(0.0001, 4, 10),
+	}, []string{"path"})
+
+	DroveResponseCacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "response_cache_requests_total",
+		Help:      "Response cache lookups grouped by result, stale entries were built from hosts since changed or expired",
+	}, []string{"result"})
 )
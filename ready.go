@@ -1,6 +1,52 @@
 package drovedns
 
-// Checks if apps data could be synced from drove cluster
+import (
+	"fmt"
+	"time"
+)
+
+// Answers for names in the plugin's zones until the first snapshot was loaded
+const (
+	NOT_READY_SERVFAIL    string = "servfail"
+	NOT_READY_REFUSE      string = "refuse"
+	NOT_READY_FALLTHROUGH string = "fallthrough"
+)
+
+// ReadinessConfig tightens readiness beyond having loaded any snapshot.
+type ReadinessConfig struct {
+	// NotReady is one of NOT_READY_SERVFAIL, NOT_READY_REFUSE or NOT_READY_FALLTHROUGH
+	NotReady string
+	// MaxSnapshotAge is how long ago apps may have been synced last, 0 disables the check
+	MaxSnapshotAge time.Duration
+	// RequireHealthyController requires at least one controller to pass health checks
+	RequireHealthyController bool
+}
+
+func (rc ReadinessConfig) Validate() error {
+	switch rc.NotReady {
+	case NOT_READY_SERVFAIL, NOT_READY_REFUSE, NOT_READY_FALLTHROUGH:
+	default:
+		return fmt.Errorf("Unknown not ready policy %s", rc.NotReady)
+	}
+	if rc.MaxSnapshotAge < 0 {
+		return fmt.Errorf("Ready max age should not be negative")
+	}
+	return nil
+}
+
+// Ready checks if apps data could be synced from drove cluster, recently enough
+// and with a reachable controller if so configured.
 func (e *DroveHandler) Ready() bool {
-	return e.DroveEndpoints.getApps() != nil
+	if e.DroveEndpoints.getApps() == nil {
+		return false
+	}
+	if age := e.Readiness.MaxSnapshotAge; age > 0 && e.DroveEndpoints.snapshotAge() > age {
+		log.Debugf("Not ready, apps were last synced %s ago", e.DroveEndpoints.snapshotAge())
+		return false
+	}
+	if e.Readiness.RequireHealthyController && !e.DroveEndpoints.Backend.Healthy() {
+		log.Debug("Not ready, no healthy controller")
+		return false
+	}
+	return true
 }
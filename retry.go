@@ -0,0 +1,110 @@
+package drovedns
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_RETRY_ATTEMPTS           int           = 3
+	DEFAULT_RETRY_BASE_BACKOFF       time.Duration = time.Duration(100) * time.Millisecond
+	DEFAULT_RETRY_MAX_BACKOFF        time.Duration = time.Duration(2) * time.Second
+	DEFAULT_CIRCUIT_BREAKER_FAILURES int           = 5
+	DEFAULT_CIRCUIT_BREAKER_COOLDOWN time.Duration = time.Duration(30) * time.Second
+	RETRY_JITTER                     float64       = 0.5
+)
+
+type RetryConfig struct {
+	Attempts    int
+	BaseBackoff time.Duration
+	MaxBackoff  time.Duration
+}
+
+func (rc RetryConfig) withDefaults() RetryConfig {
+	if rc.Attempts < 1 {
+		rc.Attempts = DEFAULT_RETRY_ATTEMPTS
+	}
+	if rc.BaseBackoff <= 0 {
+		rc.BaseBackoff = DEFAULT_RETRY_BASE_BACKOFF
+	}
+	if rc.MaxBackoff < rc.BaseBackoff {
+		rc.MaxBackoff = rc.BaseBackoff
+	}
+	return rc
+}
+
+// backoff returns the jittered delay before the given retry, doubling from
+// BaseBackoff up to MaxBackoff.
+func (rc RetryConfig) backoff(retry int) time.Duration {
+	d := rc.BaseBackoff
+	for i := 1; i < retry && d < rc.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > rc.MaxBackoff {
+		d = rc.MaxBackoff
+	}
+	return jitter(d, RETRY_JITTER)
+}
+
+type CircuitBreakerConfig struct {
+	Failures int
+	Cooldown time.Duration
+}
+
+func (cc CircuitBreakerConfig) withDefaults() CircuitBreakerConfig {
+	if cc.Failures < 1 {
+		cc.Failures = DEFAULT_CIRCUIT_BREAKER_FAILURES
+	}
+	if cc.Cooldown <= 0 {
+		cc.Cooldown = DEFAULT_CIRCUIT_BREAKER_COOLDOWN
+	}
+	return cc
+}
+
+// circuitBreaker stops requests to a controller after Failures consecutive
+// errors. Once Cooldown has passed requests are let through again, the first
+// failure reopens the circuit and the first success closes it.
+type circuitBreaker struct {
+	sync.Mutex
+	host      string
+	config    CircuitBreakerConfig
+	failures  int
+	openUntil time.Time
+}
+
+func newCircuitBreaker(host string, config CircuitBreakerConfig) *circuitBreaker {
+	return &circuitBreaker{host: host, config: config}
+}
+
+func (cb *circuitBreaker) allow() bool {
+	cb.Lock()
+	defer cb.Unlock()
+	return !time.Now().Before(cb.openUntil)
+}
+
+// reset closes the circuit, as the controller was just found healthy.
+func (cb *circuitBreaker) reset() {
+	cb.record(nil)
+}
+
+func (cb *circuitBreaker) record(err error) {
+	cb.Lock()
+	defer cb.Unlock()
+	if err == nil {
+		if cb.failures >= cb.config.Failures {
+			log.Infof("Circuit closed for controller %s", cb.host)
+		}
+		cb.failures = 0
+		cb.openUntil = time.Time{}
+		DroveCircuitOpen.WithLabelValues(cb.host).Set(0)
+		return
+	}
+	cb.failures++
+	if cb.failures >= cb.config.Failures {
+		if cb.failures == cb.config.Failures {
+			log.Warningf("Circuit opened for controller %s after %d failures", cb.host, cb.failures)
+		}
+		cb.openUntil = time.Now().Add(cb.config.Cooldown)
+		DroveCircuitOpen.WithLabelValues(cb.host).Set(1)
+	}
+}
@@ -2,6 +2,9 @@ package drovedns
 
 import (
 	"fmt"
+	"os"
+	"strconv"
+	"time"
 
 	"github.com/coredns/caddy"
 	"github.com/coredns/coredns/core/dnsserver"
@@ -37,6 +40,7 @@ func setup(c *caddy.Controller) error {
 func parseAndCreate(c *caddy.Controller) (*DroveHandler, error) {
 	c.Next() // Ignore "example" and give us the next token.
 	config := NewDroveConfig()
+	config.Zones = plugin.OriginsFromArgsOrServerBlock(c.RemainingArgs(), c.ServerBlockKeys)
 	for c.NextBlock() {
 		switch c.Val() {
 		case "endpoint":
@@ -45,6 +49,15 @@ func parseAndCreate(c *caddy.Controller) (*DroveHandler, error) {
 				return nil, c.ArgErr()
 			}
 			config.Endpoint = args[0]
+		case "apps_file":
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return nil, c.ArgErr()
+			}
+			if err := readableFile(c, args[0]); err != nil {
+				return nil, err
+			}
+			config.AppsFile = args[0]
 		case "access_token":
 			args := c.RemainingArgs()
 			if len(args) != 1 {
@@ -58,8 +71,229 @@ func parseAndCreate(c *caddy.Controller) (*DroveHandler, error) {
 				return nil, c.ArgErr()
 			}
 			config.AuthConfig.User, config.AuthConfig.Pass = args[0], args[1]
+		case "oauth2":
+			args := c.RemainingArgs()
+			if len(args) < 3 {
+				return nil, c.ArgErr()
+			}
+			config.AuthConfig.OAuth2 = OAuth2Config{TokenURL: args[0], ClientID: args[1], ClientSecret: args[2], Scopes: args[3:]}
+		case "access_token_file":
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return nil, c.ArgErr()
+			}
+			if err := readableFile(c, args[0]); err != nil {
+				return nil, err
+			}
+			config.AuthConfig.AccessTokenFile = args[0]
+		case "user_pass_file":
+			args := c.RemainingArgs()
+			if len(args) != 2 {
+				return nil, c.ArgErr()
+			}
+			for _, path := range args {
+				if err := readableFile(c, path); err != nil {
+					return nil, err
+				}
+			}
+			config.AuthConfig.UserFile, config.AuthConfig.PassFile = args[0], args[1]
 		case "skip_ssl_check":
 			config.SkipSSL = true
+		case "proxy":
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return nil, c.ArgErr()
+			}
+			config.Transport.Proxy = args[0]
+		case "proxy_from_env":
+			if len(c.RemainingArgs()) != 0 {
+				return nil, c.ArgErr()
+			}
+			config.Transport.ProxyFromEnv = true
+		case "source_address":
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return nil, c.ArgErr()
+			}
+			config.Transport.SourceAddress = args[0]
+		case "connect_timeout":
+			timeout, err := parsePositiveDuration(c)
+			if err != nil {
+				return nil, err
+			}
+			config.Transport.ConnectTimeout = timeout
+		case "tls_ca", "tls_cert", "tls_key", "tls_server_name":
+			directive := c.Val()
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return nil, c.ArgErr()
+			}
+			switch directive {
+			case "tls_ca":
+				config.TLS.CAFile = args[0]
+			case "tls_cert":
+				config.TLS.CertFile = args[0]
+			case "tls_key":
+				config.TLS.KeyFile = args[0]
+			default:
+				config.TLS.ServerName = args[0]
+			}
+		case "healthy_threshold":
+			threshold, err := parsePositiveInt(c)
+			if err != nil {
+				return nil, err
+			}
+			config.HealthyThreshold = threshold
+		case "unhealthy_threshold":
+			threshold, err := parsePositiveInt(c)
+			if err != nil {
+				return nil, err
+			}
+			config.UnhealthyThreshold = threshold
+		case "retry":
+			args := c.RemainingArgs()
+			if len(args) < 1 || len(args) > 3 {
+				return nil, c.ArgErr()
+			}
+			attempts, err := strconv.Atoi(args[0])
+			if err != nil {
+				return nil, c.Errf("retry attempts should be an integer, got %q", args[0])
+			}
+			config.Retry.Attempts = attempts
+			if len(args) > 1 {
+				if config.Retry.BaseBackoff, err = time.ParseDuration(args[1]); err != nil {
+					return nil, c.Errf("invalid retry base backoff %q: %v", args[1], err)
+				}
+			}
+			if len(args) > 2 {
+				if config.Retry.MaxBackoff, err = time.ParseDuration(args[2]); err != nil {
+					return nil, c.Errf("invalid retry max backoff %q: %v", args[2], err)
+				}
+			} else if config.Retry.MaxBackoff < config.Retry.BaseBackoff {
+				config.Retry.MaxBackoff = config.Retry.BaseBackoff
+			}
+		case "removal_guard":
+			args := c.RemainingArgs()
+			if len(args) < 1 || len(args) > 2 {
+				return nil, c.ArgErr()
+			}
+			maxPercent, err := strconv.ParseFloat(args[0], 64)
+			if err != nil || maxPercent <= 0 || maxPercent > 100 {
+				return nil, c.Errf("removal_guard percent should be in (0, 100], got %q", args[0])
+			}
+			config.SnapshotGuard.MaxRemovalPercent = maxPercent
+			if len(args) > 1 {
+				overrideAfter, err := strconv.Atoi(args[1])
+				if err != nil || overrideAfter < 0 {
+					return nil, c.Errf("removal_guard override count should be a non negative integer, got %q", args[1])
+				}
+				config.SnapshotGuard.OverrideAfter = overrideAfter
+			}
+		case "reload_debounce":
+			args := c.RemainingArgs()
+			if len(args) < 1 || len(args) > 2 {
+				return nil, c.ArgErr()
+			}
+			debounce, err := time.ParseDuration(args[0])
+			if err != nil {
+				return nil, c.Errf("invalid reload debounce %q: %v", args[0], err)
+			}
+			config.Sync.ReloadDebounce = debounce
+			if len(args) > 1 {
+				if config.Sync.ReloadMaxDelay, err = time.ParseDuration(args[1]); err != nil {
+					return nil, c.Errf("invalid reload max delay %q: %v", args[1], err)
+				}
+			} else if config.Sync.ReloadMaxDelay < debounce {
+				config.Sync.ReloadMaxDelay = debounce
+			}
+		case "event_transport":
+			args := c.RemainingArgs()
+			if len(args) < 1 || len(args) > 2 {
+				return nil, c.ArgErr()
+			}
+			config.Sync.EventTransport = args[0]
+			if len(args) > 1 {
+				if args[0] != EVENT_TRANSPORT_SSE {
+					return nil, c.Errf("stream path is only valid for the %s transport", EVENT_TRANSPORT_SSE)
+				}
+				config.Sync.EventStreamPath = args[1]
+			}
+		case "reload_events":
+			args := c.RemainingArgs()
+			if len(args) == 0 {
+				return nil, c.ArgErr()
+			}
+			config.Sync.ReloadEvents = args
+		case "event_poll_interval", "health_check_interval", "refresh_interval",
+			"fetch_apps_timeout", "fetch_events_timeout", "ping_timeout":
+			target := syncDuration(&config.Sync, c.Val())
+			duration, err := parsePositiveDuration(c)
+			if err != nil {
+				return nil, err
+			}
+			*target = duration
+		case "wait_for_sync":
+			args := c.RemainingArgs()
+			if len(args) > 1 {
+				return nil, c.ArgErr()
+			}
+			config.Sync.WaitForSync = DEFAULT_WAIT_FOR_SYNC_TIMEOUT
+			if len(args) == 1 {
+				timeout, err := time.ParseDuration(args[0])
+				if err != nil || timeout <= 0 {
+					return nil, c.Errf("wait_for_sync timeout should be a positive duration, got %q", args[0])
+				}
+				config.Sync.WaitForSync = timeout
+			}
+		case "not_ready":
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return nil, c.ArgErr()
+			}
+			config.Readiness.NotReady = args[0]
+		case "ready_max_age":
+			maxAge, err := parsePositiveDuration(c)
+			if err != nil {
+				return nil, err
+			}
+			config.Readiness.MaxSnapshotAge = maxAge
+		case "ready_require_controller":
+			if len(c.RemainingArgs()) != 0 {
+				return nil, c.ArgErr()
+			}
+			config.Readiness.RequireHealthyController = true
+		case "response_cache":
+			args := c.RemainingArgs()
+			if len(args) > 1 {
+				return nil, c.ArgErr()
+			}
+			config.ResponseCacheSize = DEFAULT_RESPONSE_CACHE_SIZE
+			if len(args) == 1 {
+				size, err := strconv.Atoi(args[0])
+				if err != nil || size <= 0 {
+					return nil, c.Errf("response cache size should be a positive integer, got %q", args[0])
+				}
+				config.ResponseCacheSize = size
+			}
+		case "packed_responses":
+			if len(c.RemainingArgs()) != 0 {
+				return nil, c.ArgErr()
+			}
+			config.PackedResponses = true
+		case "circuit_breaker":
+			args := c.RemainingArgs()
+			if len(args) != 2 {
+				return nil, c.ArgErr()
+			}
+			failures, err := strconv.Atoi(args[0])
+			if err != nil {
+				return nil, c.Errf("circuit breaker failures should be an integer, got %q", args[0])
+			}
+			cooldown, err := time.ParseDuration(args[1])
+			if err != nil {
+				return nil, c.Errf("invalid circuit breaker cooldown %q: %v", args[1], err)
+			}
+			config.CircuitBreaker = CircuitBreakerConfig{Failures: failures, Cooldown: cooldown}
 		default:
 			return nil, fmt.Errorf("Drove: Unknown argument %s found", c.Val())
 		}
@@ -69,7 +303,80 @@ func parseAndCreate(c *caddy.Controller) (*DroveHandler, error) {
 		return nil, err
 	}
 
-	drove_client := NewDroveClient(config)
-	drove_client.Init()
-	return NewDroveHandler(&drove_client), nil
+	var handler *DroveHandler
+	var initErr error
+	if config.AppsFile != "" {
+		handler = NewBackendHandler(newFileBackend(config.AppsFile, config.Sync.withDefaults().EventPollInterval), config)
+	} else {
+		drove_client := NewDroveClient(config)
+		if initErr = drove_client.Init(); initErr != nil {
+			log.Warningf("No drove leader found on startup, apps will be synced once one is: %v", initErr)
+		}
+		handler = NewDroveHandler(drove_client, config)
+	}
+	c.OnShutdown(func() error {
+		handler.DroveEndpoints.Stop()
+		return nil
+	})
+	if config.Sync.WaitForSync > 0 {
+		log.Infof("Waiting up to %s for the first app sync", config.Sync.WaitForSync)
+		if err := handler.DroveEndpoints.waitForSync(config.Sync.WaitForSync); err != nil {
+			// The instance failed to load, its shutdown callbacks may never run
+			handler.DroveEndpoints.Stop()
+			if initErr != nil {
+				return nil, fmt.Errorf("Drove: %w: %v", err, initErr)
+			}
+			return nil, fmt.Errorf("Drove: %w", err)
+		}
+	}
+	return handler, nil
+}
+
+func readableFile(c *caddy.Controller, path string) error {
+	if _, err := os.ReadFile(path); err != nil {
+		return c.Errf("unable to read %s: %v", path, err)
+	}
+	return nil
+}
+
+func parsePositiveInt(c *caddy.Controller) (int, error) {
+	directive := c.Val()
+	args := c.RemainingArgs()
+	if len(args) != 1 {
+		return 0, c.ArgErr()
+	}
+	value, err := strconv.Atoi(args[0])
+	if err != nil || value < 1 {
+		return 0, c.Errf("%s should be a positive integer, got %q", directive, args[0])
+	}
+	return value, nil
+}
+
+func parsePositiveDuration(c *caddy.Controller) (time.Duration, error) {
+	directive := c.Val()
+	args := c.RemainingArgs()
+	if len(args) != 1 {
+		return 0, c.ArgErr()
+	}
+	value, err := time.ParseDuration(args[0])
+	if err != nil || value <= 0 {
+		return 0, c.Errf("%s should be a positive duration, got %q", directive, args[0])
+	}
+	return value, nil
+}
+
+func syncDuration(sc *SyncConfig, directive string) *time.Duration {
+	switch directive {
+	case "event_poll_interval":
+		return &sc.EventPollInterval
+	case "health_check_interval":
+		return &sc.HealthCheckInterval
+	case "refresh_interval":
+		return &sc.RefreshInterval
+	case "fetch_apps_timeout":
+		return &sc.FetchAppsTimeout
+	case "fetch_events_timeout":
+		return &sc.FetchEventsTimeout
+	}
+	return &sc.PingTimeout
 }
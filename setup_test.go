@@ -1,9 +1,17 @@
 package drovedns
 
 import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -32,6 +40,70 @@ func TestSetup(t *testing.T) {
 			false,
 			"Valid config",
 		},
+		{
+			`drove {
+				endpoint http://url.random
+				oauth2 https://idp.random/token client secret drove.read
+			}`,
+			false,
+			"Valid oauth2 config",
+		},
+		{
+			`drove {
+				endpoint http://url.random
+				oauth2 https://idp.random/token client
+			}`,
+			true,
+			"Missing oauth2 client secret",
+		},
+		{
+			`drove {
+				endpoint http://url.random
+				access_token token
+				oauth2 https://idp.random/token client secret
+			}`,
+			true,
+			"Both access token and oauth2",
+		},
+		{
+			`drove {
+				endpoint https://url.random
+				access_token token
+				tls_cert /nonexistent/cert.pem
+			}`,
+			true,
+			"TLS cert without key",
+		},
+		{
+			`drove {
+				endpoint https://url.random
+				access_token token
+				tls_ca /nonexistent/ca.pem
+			}`,
+			true,
+			"Unreadable CA",
+		},
+		{
+			`drove {
+				endpoint http://url.random
+				access_token token
+				proxy socks5://proxy.random:1080
+				source_address 10.0.0.1
+				connect_timeout 2s
+			}`,
+			false,
+			"Valid transport config",
+		},
+		{
+			`drove {
+				endpoint http://url.random
+				access_token token
+				proxy http://proxy.random:3128
+				proxy_from_env
+			}`,
+			true,
+			"Both proxy and proxy from env",
+		},
 		{
 			`drove {
 				endpoint http://url.random 8080
@@ -92,6 +164,167 @@ func TestSetup(t *testing.T) {
 			true,
 			"Empty Stanza is invalid",
 		},
+		{
+			`drove {
+				endpoint http://url.random
+				access_token token
+				healthy_threshold 2
+				unhealthy_threshold 3
+			}`,
+			false,
+			"Health check thresholds",
+		},
+		{
+			`drove {
+				endpoint http://url.random
+				access_token token
+				unhealthy_threshold 0
+			}`,
+			true,
+			"Threshold should be positive",
+		},
+		{
+			`drove {
+				endpoint http://url.random
+				access_token token
+				retry 5 50ms 1s
+				circuit_breaker 3 10s
+			}`,
+			false,
+			"Retry and circuit breaker",
+		},
+		{
+			`drove {
+				endpoint http://url.random
+				access_token token
+				removal_guard 20 5
+			}`,
+			false,
+			"Removal guard",
+		},
+		{
+			`drove {
+				endpoint http://url.random
+				access_token token
+				reload_debounce 500ms 5s
+				reload_events APP_STATE_CHANGE EXECUTOR_REMOVED
+			}`,
+			false,
+			"Reload debounce and events",
+		},
+		{
+			`drove {
+				endpoint http://url.random
+				access_token token
+				reload_debounce 5s 1s
+			}`,
+			true,
+			"Max delay below debounce",
+		},
+		{
+			`drove {
+				endpoint http://url.random
+				access_token token
+				event_transport sse /events
+			}`,
+			false,
+			"Streaming event transport",
+		},
+		{
+			`drove {
+				endpoint http://url.random
+				access_token token
+				event_transport events
+			}`,
+			false,
+			"Polled event detail transport",
+		},
+		{
+			`drove {
+				endpoint http://url.random
+				access_token token
+				event_transport events /events
+			}`,
+			true,
+			"Path is only valid for sse",
+		},
+		{
+			`drove {
+				endpoint http://url.random
+				access_token token
+				event_transport websocket
+			}`,
+			true,
+			"Unknown event transport",
+		},
+		{
+			`drove {
+				endpoint http://url.random
+				access_token token
+				reload_events
+			}`,
+			true,
+			"Reload events need at least one type",
+		},
+		{
+			`drove {
+				endpoint http://url.random
+				access_token token
+				event_poll_interval 5s
+				health_check_interval 3s
+				refresh_interval 1m
+				fetch_apps_timeout 30s
+				fetch_events_timeout 10s
+				ping_timeout 1s
+			}`,
+			false,
+			"Sync intervals and timeouts",
+		},
+		{
+			`drove {
+				endpoint http://url.random
+				access_token token
+				fetch_apps_timeout 0s
+			}`,
+			true,
+			"Timeouts should be positive",
+		},
+		{
+			`drove {
+				endpoint http://url.random
+				access_token token
+				refresh_interval often
+			}`,
+			true,
+			"Intervals should be durations",
+		},
+		{
+			`drove {
+				endpoint http://url.random
+				access_token token
+				removal_guard 120
+			}`,
+			true,
+			"Removal guard above 100%",
+		},
+		{
+			`drove {
+				endpoint http://url.random
+				access_token token
+				retry 5 1s 50ms
+			}`,
+			true,
+			"Max backoff below base backoff",
+		},
+		{
+			`drove {
+				endpoint http://url.random
+				access_token token
+				circuit_breaker 3
+			}`,
+			true,
+			"Circuit breaker needs a cooldown",
+		},
 	}
 
 	for _, tt := range tests {
@@ -106,3 +339,211 @@ func TestSetup(t *testing.T) {
 	}
 
 }
+
+func TestSetupSyncConfig(t *testing.T) {
+	c := caddy.NewTestController("drovedns", `drove {
+		endpoint http://url.random
+		access_token token
+		refresh_interval 1m
+		fetch_apps_timeout 30s
+	}`)
+	handler, err := parseAndCreate(c)
+	assert.NoError(t, err)
+	client := handler.DroveEndpoints.Backend.(*droveBackend).client.(*DroveClient)
+	assert.Equal(t, 30*time.Second, client.sync.FetchAppsTimeout)
+	assert.Equal(t, FETCH_EVENTS_TIMEOUT, client.sync.FetchEventsTimeout)
+	assert.Equal(t, PING_TIMEOUT, client.sync.PingTimeout)
+}
+
+func TestSetupReadiness(t *testing.T) {
+	c := caddy.NewTestController("drovedns", `drove {
+		endpoint http://url.random
+		access_token token
+		ready_max_age 1m
+		ready_require_controller
+	}`)
+	handler, err := parseAndCreate(c)
+	assert.NoError(t, err)
+	assert.Equal(t, ReadinessConfig{NotReady: NOT_READY_SERVFAIL, MaxSnapshotAge: time.Minute, RequireHealthyController: true}, handler.Readiness)
+
+	c = caddy.NewTestController("drovedns", `drove {
+		endpoint http://url.random
+		access_token token
+		ready_max_age 0s
+	}`)
+	_, err = parseAndCreate(c)
+	assert.Error(t, err)
+}
+
+func TestSetupPackedResponses(t *testing.T) {
+	c := caddy.NewTestController("drovedns", `drove {
+		endpoint http://url.random
+		access_token token
+	}`)
+	handler, err := parseAndCreate(c)
+	assert.NoError(t, err)
+	assert.False(t, handler.PackedResponses)
+
+	c = caddy.NewTestController("drovedns", `drove {
+		endpoint http://url.random
+		access_token token
+		packed_responses
+	}`)
+	handler, err = parseAndCreate(c)
+	assert.NoError(t, err)
+	assert.True(t, handler.PackedResponses)
+}
+
+func TestSetupResponseCache(t *testing.T) {
+	c := caddy.NewTestController("drovedns", `drove {
+		endpoint http://url.random
+		access_token token
+	}`)
+	handler, err := parseAndCreate(c)
+	assert.NoError(t, err)
+	assert.Nil(t, handler.Cache)
+
+	c = caddy.NewTestController("drovedns", `drove {
+		endpoint http://url.random
+		access_token token
+		response_cache
+	}`)
+	handler, err = parseAndCreate(c)
+	assert.NoError(t, err)
+	assert.Equal(t, DEFAULT_RESPONSE_CACHE_SIZE, handler.Cache.capacity)
+
+	c = caddy.NewTestController("drovedns", `drove {
+		endpoint http://url.random
+		access_token token
+		response_cache 0
+	}`)
+	_, err = parseAndCreate(c)
+	assert.Error(t, err)
+}
+
+func TestSetupWaitForSync(t *testing.T) {
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	mux.HandleFunc("/apis/v1/ping", func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("/apis/v1/endpoints", func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(rw, `{"status": "SUCCESS", "data": [{"appId": "PS", "vhost": "example.com", "hosts": [{"host": "host", "port": 1234}]}]}`)
+	})
+
+	c := caddy.NewTestController("drovedns", fmt.Sprintf(`drove {
+		endpoint %s
+		access_token token
+		wait_for_sync 5s
+	}`, server.URL))
+	handler, err := parseAndCreate(c)
+	assert.NoError(t, err)
+	assert.NotNil(t, handler.DroveEndpoints.getApps(), "Apps should be synced before setup returns")
+
+	c = caddy.NewTestController("drovedns", `drove {
+		endpoint http://127.0.0.1:1
+		access_token token
+		retry 1
+		wait_for_sync 200ms
+	}`)
+	_, err = parseAndCreate(c)
+	assert.ErrorContains(t, err, "no apps synced from drove within 200ms")
+}
+
+func TestSetupWaitForSyncStops(t *testing.T) {
+	var requests atomic.Int64
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	mux.HandleFunc("/", func(rw http.ResponseWriter, req *http.Request) {
+		requests.Add(1)
+		if req.URL.Path != "/apis/v1/ping" {
+			rw.WriteHeader(http.StatusInternalServerError)
+		}
+	})
+
+	c := caddy.NewTestController("drovedns", fmt.Sprintf(`drove {
+		endpoint %s
+		access_token token
+		retry 1
+		health_check_interval 20ms
+		event_poll_interval 20ms
+		wait_for_sync 200ms
+	}`, server.URL))
+	_, err := parseAndCreate(c)
+	assert.Error(t, err)
+	time.Sleep(100 * time.Millisecond)
+	stopped := requests.Load()
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(t, stopped, requests.Load(), "Controllers should not be polled after setup failed")
+}
+
+func TestSetupNotReady(t *testing.T) {
+	c := caddy.NewTestController("drovedns", `drove drove.local {
+		endpoint http://url.random
+		access_token token
+		not_ready fallthrough
+	}`)
+	handler, err := parseAndCreate(c)
+	assert.NoError(t, err)
+	assert.Equal(t, NOT_READY_FALLTHROUGH, handler.Readiness.NotReady)
+	assert.Equal(t, plugin.Zones{"drove.local."}, handler.Zones)
+
+	c = caddy.NewTestController("drovedns", `drove {
+		endpoint http://url.random
+		access_token token
+		not_ready drop
+	}`)
+	_, err = parseAndCreate(c)
+	assert.Error(t, err)
+}
+
+func TestSetupCredentialFiles(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"token", "user", "pass"} {
+		assert.Nil(t, os.WriteFile(filepath.Join(dir, name), []byte(name), 0600))
+	}
+	c := caddy.NewTestController("drovedns", fmt.Sprintf(`drove {
+		endpoint http://url.random
+		user_pass_file %s %s
+	}`, filepath.Join(dir, "user"), filepath.Join(dir, "pass")))
+	_, err := parseAndCreate(c)
+	assert.NoError(t, err)
+
+	c = caddy.NewTestController("drovedns", fmt.Sprintf(`drove {
+		endpoint http://url.random
+		access_token_file %s
+	}`, filepath.Join(dir, "missing")))
+	_, err = parseAndCreate(c)
+	assert.ErrorContains(t, err, "unable to read")
+
+	c = caddy.NewTestController("drovedns", fmt.Sprintf(`drove {
+		endpoint http://url.random
+		access_token token
+		access_token_file %s
+	}`, filepath.Join(dir, "token")))
+	_, err = parseAndCreate(c)
+	assert.Error(t, err, "Only one auth method should be allowed")
+}
+
+func TestSetupAppsFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "apps.json")
+	assert.Nil(t, os.WriteFile(path, []byte(`{"data": [{"appId": "PS", "vhost": "ps.drove", "hosts": [{"host": "host", "port": 1234}]}]}`), 0600))
+	c := caddy.NewTestController("drovedns", fmt.Sprintf(`drove {
+		apps_file %s
+		wait_for_sync 1s
+	}`, path))
+	handler, err := parseAndCreate(c)
+	assert.NoError(t, err)
+	assert.NotNil(t, handler.DroveEndpoints.searchApps("ps.drove."))
+
+	c = caddy.NewTestController("drovedns", fmt.Sprintf(`drove {
+		endpoint http://url.random
+		access_token token
+		apps_file %s
+	}`, path))
+	_, err = parseAndCreate(c)
+	assert.Error(t, err, "Endpoint and apps file are exclusive")
+}
@@ -0,0 +1,121 @@
+package drovedns
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const MAX_EVENT_SIZE int = 1024 * 1024
+
+// StreamEvents consumes the server sent event feed of the leader and calls
+// callback for every event. It blocks until the stream ends, the leader changes
+// or an error occurs. ErrStreamUnsupported is returned if the controller doesn't
+// offer an event stream.
+func (c *DroveClient) StreamEvents(callback func(event *DroveEvent)) error {
+	host, err := c.endpoint()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.cancelOnLeaderChange(ctx, cancel, host)
+
+	path := c.sync.EventStreamPath
+	req, err := http.NewRequestWithContext(ctx, "GET", host+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := c.send(req)
+	if err != nil {
+		DroveApiRequests.WithLabelValues("err", "GET", host).Inc()
+		return transportError(host, path, err)
+	}
+	DroveApiRequests.WithLabelValues(strconv.Itoa(resp.StatusCode), "GET", host).Inc()
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound, http.StatusMethodNotAllowed, http.StatusNotImplemented:
+		return errors.Join(ErrStreamUnsupported, &DroveApiError{Kind: ApiErrorUnexpectedStatus, Host: host, Path: path, StatusCode: resp.StatusCode})
+	default:
+		return &DroveApiError{Kind: statusErrorKind(resp.StatusCode), Host: host, Path: path, StatusCode: resp.StatusCode}
+	}
+	if contentType := resp.Header.Get("Content-Type"); !strings.HasPrefix(contentType, "text/event-stream") {
+		return errors.Join(ErrStreamUnsupported, &DroveApiError{Kind: ApiErrorUnexpectedStatus, Host: host, Path: path, StatusCode: resp.StatusCode, Message: "content type " + contentType})
+	}
+
+	log.Infof("Connected to event stream of %s", host)
+	DroveEventStreamConnected.Set(1)
+	defer DroveEventStreamConnected.Set(0)
+	err = readEventStream(resp.Body, callback)
+	if ctx.Err() != nil {
+		return errors.New("leader changed, event stream of " + host + " closed")
+	}
+	return err
+}
+
+// cancelOnLeaderChange closes the stream once host stops being the leader or the
+// client is stopped.
+func (c *DroveClient) cancelOnLeaderChange(ctx context.Context, cancel context.CancelFunc, host string) {
+	ticker := time.NewTicker(c.sync.HealthCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.done:
+			cancel()
+			return
+		case <-ticker.C:
+			if leader := c.leader(); leader == nil || leader.Endpoint != host {
+				cancel()
+				return
+			}
+		}
+	}
+}
+
+// readEventStream parses the text/event-stream format. Only data fields are used,
+// each event carries a JSON encoded DroveEvent.
+func readEventStream(body io.Reader, callback func(event *DroveEvent)) error {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 0, 64*1024), MAX_EVENT_SIZE)
+	var data bytes.Buffer
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		switch {
+		case len(line) == 0:
+			if data.Len() > 0 {
+				dispatchEvent(data.Bytes(), callback)
+				data.Reset()
+			}
+		case bytes.HasPrefix(line, []byte("data:")):
+			if data.Len() > 0 {
+				data.WriteByte('\n')
+			}
+			data.Write(bytes.TrimPrefix(bytes.TrimPrefix(line, []byte("data:")), []byte(" ")))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return io.ErrUnexpectedEOF
+}
+
+func dispatchEvent(data []byte, callback func(event *DroveEvent)) {
+	event := &DroveEvent{}
+	if err := json.Unmarshal(data, event); err != nil {
+		log.Warningf("Ignoring undecodable event %q: %v", data, err)
+		return
+	}
+	callback(event)
+}
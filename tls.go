@@ -0,0 +1,173 @@
+package drovedns
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// TLSConfig configures how controllers are verified and how the plugin
+// authenticates to them. All files are read again when they change.
+type TLSConfig struct {
+	CAFile     string
+	CertFile   string
+	KeyFile    string
+	ServerName string
+}
+
+func (tc TLSConfig) Validate() error {
+	if (tc.CertFile == "") != (tc.KeyFile == "") {
+		return fmt.Errorf("TLS cert and key should both be set")
+	}
+	r := newTLSReloader(tc)
+	if tc.CAFile != "" {
+		if _, err := r.caPool(); err != nil {
+			return err
+		}
+	}
+	if tc.CertFile != "" {
+		if _, err := r.clientCertificate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// tlsReloader serves the CA pool and client certificate, reloading them once
+// their files changed. Connections already established keep their certificates.
+type tlsReloader struct {
+	config TLSConfig
+	mutex  sync.Mutex
+	stamps map[string]fileStamp
+	pool   *x509.CertPool
+	cert   *tls.Certificate
+}
+
+func newTLSReloader(config TLSConfig) *tlsReloader {
+	return &tlsReloader{config: config, stamps: make(map[string]fileStamp)}
+}
+
+// changed reports whether any of paths changed since the last call. Must be
+// called with the mutex held.
+func (r *tlsReloader) changed(paths ...string) bool {
+	changed := false
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			// Let the following read report the error
+			return true
+		}
+		stamp := fileStamp{info.ModTime(), info.Size()}
+		if r.stamps[path] != stamp {
+			r.stamps[path] = stamp
+			changed = true
+		}
+	}
+	return changed
+}
+
+func (r *tlsReloader) caPool() (*x509.CertPool, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if changed := r.changed(r.config.CAFile); r.pool != nil && !changed {
+		return r.pool, nil
+	}
+	pem, err := os.ReadFile(r.config.CAFile)
+	if err == nil {
+		pool := x509.NewCertPool()
+		if pool.AppendCertsFromPEM(pem) {
+			if r.pool != nil {
+				log.Infof("Reloaded CA certificates from %s", r.config.CAFile)
+			}
+			r.pool = pool
+			DroveTLSReloads.WithLabelValues("ca").Inc()
+			return pool, nil
+		}
+		err = fmt.Errorf("no certificates found")
+	}
+	if r.pool != nil {
+		log.Warningf("Unable to reload CA certificates from %s, keeping previous ones: %v", r.config.CAFile, err)
+		return r.pool, nil
+	}
+	return nil, fmt.Errorf("Unable to load CA certificates from %s: %v", r.config.CAFile, err)
+}
+
+func (r *tlsReloader) clientCertificate() (*tls.Certificate, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if changed := r.changed(r.config.CertFile, r.config.KeyFile); r.cert != nil && !changed {
+		return r.cert, nil
+	}
+	cert, err := tls.LoadX509KeyPair(r.config.CertFile, r.config.KeyFile)
+	if err != nil {
+		if r.cert != nil {
+			// Cert and key are usually not replaced atomically, retry on the next handshake
+			log.Warningf("Unable to reload client certificate from %s, keeping previous one: %v", r.config.CertFile, err)
+			delete(r.stamps, r.config.CertFile)
+			delete(r.stamps, r.config.KeyFile)
+			return r.cert, nil
+		}
+		return nil, fmt.Errorf("Unable to load client certificate from %s: %v", r.config.CertFile, err)
+	}
+	if r.cert != nil {
+		log.Infof("Reloaded client certificate from %s", r.config.CertFile)
+	}
+	r.cert = &cert
+	DroveTLSReloads.WithLabelValues("client_cert").Inc()
+	return r.cert, nil
+}
+
+// verifyConnectionTo verifies the controller certificate against the current CA
+// pool and name, replacing the verification skipped through InsecureSkipVerify.
+// name is a host name or IP address.
+func (r *tlsReloader) verifyConnectionTo(name string) func(cs tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return fmt.Errorf("controller presented no certificate")
+		}
+		pool, err := r.caPool()
+		if err != nil {
+			return err
+		}
+		opts := x509.VerifyOptions{Roots: pool, DNSName: name, Intermediates: x509.NewCertPool()}
+		for _, cert := range cs.PeerCertificates[1:] {
+			opts.Intermediates.AddCert(cert)
+		}
+		_, err = cs.PeerCertificates[0].Verify(opts)
+		return err
+	}
+}
+
+// newTLSClientConfig builds the client TLS config for controller connections.
+// With a CA set verifyHost is returned as well. The connection state doesn't
+// tell which host was dialled, so every host needs a config of its own with
+// VerifyConnection set to verifyHost(host).
+func newTLSClientConfig(config TLSConfig, skipSSL bool) (*tls.Config, func(host string) func(tls.ConnectionState) error) {
+	tc := &tls.Config{InsecureSkipVerify: skipSSL, ServerName: config.ServerName}
+	r := newTLSReloader(config)
+	if config.CertFile != "" {
+		tc.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return r.clientCertificate()
+		}
+	}
+	if config.CAFile == "" || skipSSL {
+		return tc, nil
+	}
+	// The standard verification can't pick up a rotated CA, so it is done
+	// by VerifyConnection instead
+	tc.InsecureSkipVerify = true
+	return tc, func(host string) func(tls.ConnectionState) error {
+		if config.ServerName != "" {
+			return r.verifyConnectionTo(config.ServerName)
+		}
+		return r.verifyConnectionTo(host)
+	}
+}
@@ -0,0 +1,115 @@
+package drovedns
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// TransportConfig controls how connections to controllers are established.
+type TransportConfig struct {
+	// Proxy is an http, https or socks5 proxy URL
+	Proxy        string
+	ProxyFromEnv bool
+	// SourceAddress is the local IP connections are made from
+	SourceAddress string
+	// ConnectTimeout bounds establishing a connection, 0 leaves it to the request timeout
+	ConnectTimeout time.Duration
+}
+
+func (tc TransportConfig) Validate() error {
+	if tc.Proxy != "" && tc.ProxyFromEnv {
+		return fmt.Errorf("Only one of proxy and proxy from environment should be set")
+	}
+	if tc.Proxy != "" {
+		if _, err := parseProxyURL(tc.Proxy); err != nil {
+			return err
+		}
+	}
+	if tc.SourceAddress != "" && net.ParseIP(tc.SourceAddress) == nil {
+		return fmt.Errorf("Invalid source address %s", tc.SourceAddress)
+	}
+	if tc.ConnectTimeout < 0 {
+		return fmt.Errorf("Connect timeout should not be negative")
+	}
+	return nil
+}
+
+func parseProxyURL(proxy string) (*url.URL, error) {
+	proxyURL, err := url.Parse(proxy)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid proxy %s: %v", proxy, err)
+	}
+	switch proxyURL.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("Unsupported proxy scheme %q, use http, https or socks5", proxyURL.Scheme)
+	}
+	return proxyURL, nil
+}
+
+// hostTransport hands every host a transport of its own, whose TLS config
+// verifies certificates against that host.
+type hostTransport struct {
+	base       *http.Transport
+	verifyHost func(host string) func(tls.ConnectionState) error
+	mutex      sync.Mutex
+	hosts      map[string]*http.Transport
+}
+
+func (t *hostTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.transport(req.URL.Hostname()).RoundTrip(req)
+}
+
+func (t *hostTransport) transport(host string) *http.Transport {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if tr, ok := t.hosts[host]; ok {
+		return tr
+	}
+	tr := t.base.Clone()
+	tr.TLSClientConfig.VerifyConnection = t.verifyHost(host)
+	t.hosts[host] = tr
+	return tr
+}
+
+func (t *hostTransport) CloseIdleConnections() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for _, tr := range t.hosts {
+		tr.CloseIdleConnections()
+	}
+}
+
+// newTransport builds the transport shared by all controller requests. The
+// dialer is used for proxy connections as well.
+func newTransport(config DroveConfig) http.RoundTripper {
+	tc := config.Transport
+	dialer := &net.Dialer{Timeout: tc.ConnectTimeout, KeepAlive: 30 * time.Second}
+	if tc.SourceAddress != "" {
+		dialer.LocalAddr = &net.TCPAddr{IP: net.ParseIP(tc.SourceAddress)}
+	}
+	tlsConfig, verifyHost := newTLSClientConfig(config.TLS, config.SkipSSL)
+	tr := &http.Transport{
+		MaxIdleConnsPerHost: 10,
+		TLSClientConfig:     tlsConfig,
+		DialContext:         dialer.DialContext,
+		TLSHandshakeTimeout: tc.ConnectTimeout,
+	}
+	switch {
+	case tc.ProxyFromEnv:
+		tr.Proxy = http.ProxyFromEnvironment
+	case tc.Proxy != "":
+		// Validated on setup
+		proxyURL, _ := parseProxyURL(tc.Proxy)
+		tr.Proxy = http.ProxyURL(proxyURL)
+	}
+	if verifyHost != nil {
+		return &hostTransport{base: tr, verifyHost: verifyHost, hosts: make(map[string]*http.Transport)}
+	}
+	return tr
+}
@@ -0,0 +1,100 @@
+package drovedns
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_RELOAD_DEBOUNCE  time.Duration = time.Duration(200) * time.Millisecond
+	DEFAULT_RELOAD_MAX_DELAY time.Duration = time.Duration(1) * time.Second
+)
+
+// reloadTrigger coalesces reload requests. A reload fires on C once no new
+// request arrived for the debounce window, but at most maxDelay after the first
+// request. Requests arriving while the consumer is still busy with the previous
+// reload are folded into a single follow-up reload.
+type reloadTrigger struct {
+	debounce time.Duration
+	maxDelay time.Duration
+	pending  chan struct{}
+	C        chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+func newReloadTrigger(debounce time.Duration, maxDelay time.Duration) *reloadTrigger {
+	if maxDelay < debounce {
+		maxDelay = debounce
+	}
+	t := &reloadTrigger{
+		debounce: debounce,
+		maxDelay: maxDelay,
+		pending:  make(chan struct{}, 1),
+		C:        make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go t.loop()
+	return t
+}
+
+// Trigger requests a reload without blocking.
+func (t *reloadTrigger) Trigger() {
+	select {
+	case t.pending <- struct{}{}:
+	default:
+		DroveReloadsCoalesced.Inc()
+	}
+}
+
+// Stop ends the trigger, no reload fires afterwards.
+func (t *reloadTrigger) Stop() {
+	t.stopOnce.Do(func() { close(t.done) })
+}
+
+func (t *reloadTrigger) loop() {
+	for {
+		select {
+		case <-t.done:
+			return
+		case <-t.pending:
+		}
+		if t.debounce > 0 && !t.wait() {
+			return
+		}
+		select {
+		case <-t.done:
+			return
+		case t.C <- struct{}{}:
+		}
+	}
+}
+
+// wait returns once no request arrived for the debounce window, false if the
+// trigger was stopped meanwhile.
+func (t *reloadTrigger) wait() bool {
+	deadline := time.Now().Add(t.maxDelay)
+	timer := time.NewTimer(t.debounce)
+	defer timer.Stop()
+	for {
+		select {
+		case <-t.pending:
+			DroveReloadsCoalesced.Inc()
+			next := time.Until(deadline)
+			if next > t.debounce {
+				next = t.debounce
+			}
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(next)
+		case <-timer.C:
+			return true
+		case <-t.done:
+			return false
+		}
+	}
+}
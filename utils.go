@@ -1,8 +1,29 @@
 package drovedns
 
+import (
+	"math/rand"
+	"time"
+)
+
 func boolToDouble(varr bool) float64 {
 	if varr {
 		return 1.0
 	}
 	return 0.0
 }
+
+func atLeastOne(varr int) int {
+	if varr < 1 {
+		return 1
+	}
+	return varr
+}
+
+// jitter returns d randomly spread by up to +/- fraction of its value.
+func jitter(d time.Duration, fraction float64) time.Duration {
+	if d <= 0 || fraction <= 0 {
+		return d
+	}
+	delta := (rand.Float64()*2 - 1) * fraction * float64(d)
+	return d + time.Duration(delta)
+}